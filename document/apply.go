@@ -0,0 +1,180 @@
+package document
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Workiva/go-datastructures/common"
+	"github.com/Workiva/go-datastructures/slice/skip"
+	"github.com/mezis/lseq/position"
+)
+
+// ErrAnomalies is returned by `Patch.ApplyStrict` for patches with duplicate,
+// missing, or conflicting items.
+var ErrAnomalies = errors.New("document: patch has duplicate, missing, or conflicting items")
+
+// ApplyResult -
+// The outcome of applying each item of a patch; see `Patch.Apply`.
+//
+// Anomalies are expected now and then, eg. when patches are reordered or
+// re-delivered in transit; many of them hint at buggy peers.
+type ApplyResult struct {
+	// The patch was applied before, so nothing was done, and the lists below
+	// are empty; see `Document.Applied`.
+	Redelivered bool
+
+	// Items that changed the document as intended.
+	Applied []Item
+	// Insertions of atoms present or deleted already, and deletions of atoms
+	// deleted already.
+	Duplicate []Item
+	// Deletions of atoms never inserted; their positions are kept as
+	// tombstones nonetheless.
+	Missing []Item
+	// Insertions at positions holding other data, deletions of atoms holding
+	// other data (the atoms are deleted nonetheless), and items at invalid
+	// positions.
+	Conflicting []Item
+}
+
+// OK returns true iff the result has no anomalies, ie. all items were applied,
+// or the patch was redelivered.
+func (r ApplyResult) OK() bool {
+	return len(r.Duplicate) == 0 && len(r.Missing) == 0 && len(r.Conflicting) == 0
+}
+
+// Apply
+// iterates through patch items and applies them all to the argument Document,
+// and reports how each went.
+//
+// Returns `position.ErrShapeMismatch`, and applies nothing, if the patch has
+// positions of another shape than the document's; ie. it comes from a replica
+// created with another shape.
+//
+// Applying a patch again, eg. when re-delivered by a gossip layer, is a no-op;
+// see `Document.Applied`.
+func (p *Patch) Apply(doc *Document) (ApplyResult, error) {
+	return p.apply(doc, false)
+}
+
+// ApplyStrict -
+// Like `Apply`, but returns `ErrAnomalies` along with the result, and applies
+// nothing, if any item is a duplicate, missing, or conflicting. Re-applying a
+// patch is not an error.
+func (p *Patch) ApplyStrict(doc *Document) (ApplyResult, error) {
+	return p.apply(doc, true)
+}
+
+func (p *Patch) apply(doc *Document, strict bool) (ApplyResult, error) {
+	id := p.ID()
+	if doc.Applied(id) {
+		return ApplyResult{Redelivered: true}, nil
+	}
+	for _, i := range p.items {
+		if !doc.fits(i.pos) {
+			return ApplyResult{}, position.ErrShapeMismatch
+		}
+	}
+
+	if strict {
+		if res := p.dryRun(doc); !res.OK() {
+			return res, ErrAnomalies
+		}
+	}
+
+	var res ApplyResult
+	doc.applied[id] = struct{}{}
+	for _, i := range p.items {
+		var s slot
+		s.data, s.present, s.deleted = doc.lookup(i.pos)
+		var ok bool
+		switch i.op {
+		case OpInsert:
+			ok = doc.Insert(i.pos, i.data)
+		case OpDelete:
+			ok = doc.Delete(i.pos)
+		default:
+			panic(fmt.Sprintf("unknown patch operation %#v", i.op))
+		}
+		res.add(i, s, ok)
+	}
+	return res, nil
+}
+
+// State of a position: the data of its atom, if present; and whether it has a
+// tombstone.
+type slot struct {
+	data             string
+	present, deleted bool
+}
+
+// Add `i` to the list of `r` it belongs to, given the state `s` of its
+// position before, and whether applying it changed the document (`ok`).
+func (r *ApplyResult) add(i Item, s slot, ok bool) {
+	list := &r.Applied
+	switch {
+	case i.pos.Validate() != nil:
+		list = &r.Conflicting
+	case i.op == OpInsert && !ok:
+		list = &r.Duplicate
+		if s.present && s.data != i.data {
+			list = &r.Conflicting
+		}
+	case i.op == OpInsert:
+	case ok:
+		if s.data != i.data {
+			list = &r.Conflicting
+		}
+	case s.deleted:
+		list = &r.Duplicate
+	default:
+		list = &r.Missing
+	}
+	*list = append(*list, i)
+}
+
+// A position in the dry run of a patch, and its state; ordered by position.
+type overlay struct {
+	pos *position.Position
+	slot
+}
+
+func (o *overlay) Compare(b common.Comparator) int {
+	return o.pos.Compare(b.(*overlay).pos)
+}
+
+// Return how each item would go if the patch was applied to `doc`, without
+// changing it.
+func (p *Patch) dryRun(doc *Document) ApplyResult {
+	var out ApplyResult
+	// positions changed by the items so far
+	changed := skip.New(uint8(0))
+
+	for _, i := range p.items {
+		o := &overlay{pos: i.pos}
+		if c := changed.Get(o)[0]; c != nil {
+			o = c.(*overlay)
+		} else {
+			o.data, o.present, o.deleted = doc.lookup(i.pos)
+			changed.Insert(o)
+		}
+
+		// as `Document.Insert` and `Document.Delete` do
+		ok := false
+		next := o.slot
+		switch {
+		case i.pos.Validate() != nil:
+		case i.op == OpInsert && (o.present || o.deleted):
+		case i.op == OpInsert:
+			ok, next = true, slot{data: i.data, present: true}
+		case o.present:
+			ok, next = true, slot{deleted: true}
+		default:
+			next.deleted = true
+		}
+
+		out.add(i, o.slot, ok)
+		o.slot = next
+	}
+	return out
+}
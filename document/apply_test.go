@@ -0,0 +1,131 @@
+package document_test
+
+import (
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Patch.Apply", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	var (
+		doc *Document
+		pos []*position.Position
+	)
+	BeforeEach(func() {
+		doc = NewDocument()
+		pos, _ = doc.Allocate(0, 3, site)
+		doc.Insert(pos[0], "hello")
+		doc.Insert(pos[1], "world")
+		doc.Delete(pos[1])
+	})
+
+	apply := func(items ...Item) ApplyResult {
+		res, err := NewPatchFromItems(site, items...).Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	It("reports applied items", func() {
+		ins, del := NewItem(OpInsert, pos[2], "!"), NewItem(OpDelete, pos[0], "hello")
+		res := apply(ins, del)
+		Expect(res.OK()).To(BeTrue())
+		Expect(res.Applied).To(Equal([]Item{ins, del}))
+		Expect(doc.Data()).To(Equal([]string{"!"}))
+	})
+
+	It("reports duplicate insertions", func() {
+		present, deleted := NewItem(OpInsert, pos[0], "hello"), NewItem(OpInsert, pos[1], "world")
+		res := apply(present, deleted)
+		Expect(res.OK()).To(BeFalse())
+		Expect(res.Duplicate).To(Equal([]Item{present, deleted}))
+		Expect(res.Applied).To(BeEmpty())
+	})
+
+	It("reports duplicate deletions", func() {
+		del := NewItem(OpDelete, pos[1], "world")
+		Expect(apply(del).Duplicate).To(Equal([]Item{del}))
+	})
+
+	It("reports deletions of unknown atoms", func() {
+		del := NewItem(OpDelete, pos[2], "!")
+		Expect(apply(del).Missing).To(Equal([]Item{del}))
+		Expect(doc.Tombstones()).To(Equal(2))
+	})
+
+	It("reports conflicting insertions", func() {
+		ins := NewItem(OpInsert, pos[0], "bonjour")
+		Expect(apply(ins).Conflicting).To(Equal([]Item{ins}))
+		Expect(doc.Data()).To(Equal([]string{"hello"}))
+	})
+
+	It("reports conflicting deletions, and deletes anyway", func() {
+		del := NewItem(OpDelete, pos[0], "bonjour")
+		Expect(apply(del).Conflicting).To(Equal([]Item{del}))
+		Expect(doc.Data()).To(BeEmpty())
+	})
+
+	It("reports items at invalid positions", func() {
+		ins := NewItem(OpInsert, position.DefaultShape().Head(), "oops")
+		Expect(apply(ins).Conflicting).To(Equal([]Item{ins}))
+	})
+
+	It("accounts for earlier items of the patch", func() {
+		ins, del := NewItem(OpInsert, pos[2], "!"), NewItem(OpDelete, pos[2], "!")
+		res := apply(ins, del, ins, del)
+		Expect(res.Applied).To(Equal([]Item{ins, del}))
+		Expect(res.Duplicate).To(Equal([]Item{ins, del}))
+	})
+
+	It("reports items at equal positions spelled differently", func() {
+		// padded with a zero digit, which compares equal
+		padded := pos[2].Append(0, 0)
+		Expect(padded.Compare(pos[2])).To(Equal(0))
+		ins, again := NewItem(OpInsert, pos[2], "X"), NewItem(OpInsert, padded, "Y")
+
+		p := NewPatchFromItems(site, ins, again)
+		res, err := p.ApplyStrict(doc)
+		Expect(err).To(MatchError(ErrAnomalies))
+		Expect(res.Conflicting).To(Equal([]Item{again}))
+
+		res = apply(ins, again)
+		Expect(res.Applied).To(Equal([]Item{ins}))
+		Expect(res.Conflicting).To(Equal([]Item{again}))
+		Expect(doc.Data()).To(Equal([]string{"hello", "X"}))
+	})
+
+	It("reports redelivered patches", func() {
+		p := NewPatchFromItems(site, NewItem(OpInsert, pos[2], "!"))
+		_, err := p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		res, err := p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(ApplyResult{Redelivered: true}))
+		Expect(res.OK()).To(BeTrue())
+	})
+
+	Describe("ApplyStrict", func() {
+		It("applies patches without anomalies", func() {
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[2], "!"))
+			res, err := p.ApplyStrict(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Applied).To(HaveLen(1))
+			Expect(doc.Data()).To(Equal([]string{"hello", "!"}))
+		})
+
+		It("applies nothing from patches with anomalies", func() {
+			ins, del := NewItem(OpInsert, pos[2], "!"), NewItem(OpDelete, pos[1], "world")
+			p := NewPatchFromItems(site, ins, del)
+			res, err := p.ApplyStrict(doc)
+			Expect(err).To(MatchError(ErrAnomalies))
+			Expect(res.Applied).To(Equal([]Item{ins}))
+			Expect(res.Duplicate).To(Equal([]Item{del}))
+			Expect(doc.Data()).To(Equal([]string{"hello"}))
+			Expect(doc.Applied(p.ID())).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,63 @@
+package document
+
+import "github.com/mezis/lseq/uid"
+
+// Compose returns a patch with the effect of applying `a`, then `b`; see
+// `Squash`.
+func Compose(a, b *Patch) *Patch {
+	return Squash([]*Patch{a, b})
+}
+
+// Squash -
+// Return a single patch with the effect of applying `patches` in order, eg. to
+// send the patches of an offline session at once. It has the site of the first
+// patch, and a new `ID`.
+//
+// Atoms inserted and then deleted cancel out, and items repeated are dropped,
+// so the result is usually much shorter. As replicas never learn about
+// cancelled atoms, only squash patches that were not sent yet: a replica that
+// applied one of them may keep an atom that the others deleted.
+func Squash(patches []*Patch) *Patch {
+	var site uid.Uid
+	if len(patches) > 0 {
+		site = patches[0].site
+	}
+	out := NewPatchFromItems(site)
+
+	// indices in `items` of the insertion and deletion of each position, or -1
+	type entry struct{ ins, del int }
+	entries := make(map[string]*entry)
+	items := []Item{}
+	for _, p := range patches {
+		for _, i := range p.items {
+			key := i.pos.String()
+			e := entries[key]
+			if e == nil {
+				e = &entry{-1, -1}
+				entries[key] = e
+			}
+			idx := &e.del
+			if i.op == OpInsert {
+				idx = &e.ins
+			}
+			if *idx >= 0 {
+				continue
+			}
+			*idx = len(items)
+			items = append(items, i)
+		}
+	}
+
+	drop := make([]bool, len(items))
+	for _, e := range entries {
+		if e.ins >= 0 && e.del > e.ins {
+			drop[e.ins], drop[e.del] = true, true
+		}
+	}
+	for k, i := range items {
+		if !drop[k] {
+			out.items = append(out.items, i)
+		}
+	}
+	return out
+}
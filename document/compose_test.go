@@ -0,0 +1,106 @@
+package document_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Squash", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	// Apply patches editing `doc` into each of `states`, and return them.
+	edit := func(doc *Document, states ...[]string) []*Patch {
+		out := []*Patch{}
+		for _, data := range states {
+			p, err := NewPatch(doc, site, data)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			out = append(out, p)
+		}
+		return out
+	}
+
+	snapshot := func(doc *Document) io.Reader {
+		var buf bytes.Buffer
+		_, err := doc.WriteTo(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		return &buf
+	}
+
+	It("returns an empty patch for no patches", func() {
+		Expect(Squash(nil).Length()).To(Equal(0))
+	})
+
+	It("cancels out atoms inserted then deleted", func() {
+		doc := NewDocument()
+		patches := edit(doc, []string{"hello", "world"}, []string{"hello"})
+		p := Compose(patches[0], patches[1])
+		Expect(p.Site()).To(Equal(site))
+		Expect(p.Items()).To(Equal(patches[0].Items()[:1]))
+	})
+
+	It("keeps deletions of atoms inserted earlier", func() {
+		doc := NewDocument()
+		edit(doc, []string{"hello", "world"})
+		patches := edit(doc, []string{"hello"}, []string{"hello", "!"})
+		p := Compose(patches[0], patches[1])
+		Expect(p.Items()).To(Equal(append(patches[0].Items(), patches[1].Items()...)))
+	})
+
+	It("drops repeated items", func() {
+		doc := NewDocument()
+		patches := edit(doc, []string{"hello"})
+		Expect(Compose(patches[0], patches[0]).Items()).To(Equal(patches[0].Items()))
+	})
+
+	It("has the effect of the patches applied in order", func() {
+		for seed := int64(0); seed < 20; seed++ {
+			rnd := rand.New(rand.NewSource(seed))
+			base := NewDocument(WithAllocator(position.WithSeed(seed)))
+			edit(base, []string{"a", "b", "c", "d", "e"})
+			origin, err := ReadFrom(snapshot(base))
+			Expect(err).NotTo(HaveOccurred())
+			replica, err := ReadFrom(snapshot(base))
+			Expect(err).NotTo(HaveOccurred())
+
+			patches := []*Patch{}
+			for k := 0; k < 100; k++ {
+				data := origin.Data()
+				next := []string{}
+				if len(data) > 0 && rnd.Intn(2) == 0 {
+					idx := rnd.Intn(len(data))
+					next = append(next, data[:idx]...)
+					next = append(next, data[idx+1:]...)
+				} else {
+					idx := rnd.Intn(len(data) + 1)
+					next = append(next, data[:idx]...)
+					next = append(next, fmt.Sprintf("edit %d", k))
+					next = append(next, data[idx:]...)
+				}
+				patches = append(patches, edit(origin, next)...)
+			}
+
+			p := Squash(patches)
+			res, err := p.Apply(replica)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.OK()).To(BeTrue())
+			Expect(replica.Data()).To(Equal(origin.Data()))
+
+			total := 0
+			for _, q := range patches {
+				total += q.Length()
+			}
+			Expect(p.Length()).To(BeNumerically("<", total))
+		}
+	})
+})
@@ -10,8 +10,22 @@ import (
 // Document is a mutable ordered lists of atoms (e.g lines, characters)
 type Document struct {
 	uid.Uid
-	atoms *skip.SkipList
+	// persistent, so that snapshots share it; see `Snapshot`
+	atoms *node
 	alloc *position.Allocator
+	// positions of deleted atoms, including the head sentinel so that it
+	// isn't empty; see `Delete`.
+	tombs *skip.SkipList
+	// IDs of the patches applied
+	applied map[PatchID]struct{}
+	// see `Subscribe`; copied on write
+	subs []*subscription
+	// last presence update of each site; see `PresenceUpdate`
+	presence map[uid.Uid]*presence
+	// last presence update created for each site, and the epoch of those
+	// created first; see `NewPresenceUpdate`
+	presenceStamps map[uid.Uid]stamp
+	epoch          uint64
 }
 
 type atom struct {
@@ -30,22 +44,61 @@ func (a *atom) Compare(b common.Comparator) int {
 	return a.pos.Compare(b.(*atom).pos)
 }
 
-// NewDocument returns a new document
+// Option -
+// Configures a `Document` built by `NewDocument`.
+type Option func(*config)
+
+type config struct {
+	alloc []position.Option
+}
+
+// WithAllocator -
+// Configure the document's allocator with `opts`; eg. `position.WithSeed`
+// makes its allocations reproducible, and `position.WithShape` sets the shape
+// of its positions.
+func WithAllocator(opts ...position.Option) Option {
+	return func(c *config) {
+		c.alloc = append(c.alloc, opts...)
+	}
+}
+
+// NewDocument returns a new document, configured by `opts`.
 //
 // Internally, this has two unremovable atoms - "start" and "stop" sentinels
-func NewDocument() *Document {
+func NewDocument(opts ...Option) *Document {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+
 	doc := new(Document)
 	doc.Uid = uid.Generate()
-	doc.atoms = skip.New(uint8(0))
-	doc.atoms.Insert(newAtom(position.SentinelHead, ""))
-	doc.atoms.Insert(newAtom(position.SentinelTail, ""))
-	doc.alloc = position.NewAllocator()
+	doc.alloc = position.NewAllocator(c.alloc...)
+	doc.atoms = doc.atoms.insert(newAtom(doc.alloc.Shape().Head(), ""))
+	doc.atoms = doc.atoms.insert(newAtom(doc.alloc.Shape().Tail(), ""))
+	doc.tombs = skip.New(uint8(0))
+	doc.tombs.Insert(newAtom(doc.alloc.Shape().Head(), ""))
+	doc.applied = make(map[PatchID]struct{})
+	doc.presence = make(map[uid.Uid]*presence)
+	doc.presenceStamps = make(map[uid.Uid]stamp)
+	doc.epoch = newEpoch()
 	return doc
 }
 
+// Shape returns the shape of the positions in the document. Replicas of a
+// document must share it.
+func (doc *Document) Shape() position.TreeShape {
+	return doc.alloc.Shape()
+}
+
+// Returns true iff `pos` is of the document's shape.
+func (doc *Document) fits(pos *position.Position) bool {
+	return pos.Shape().Compatible(doc.alloc.Shape())
+}
+
 // Length returns the current number of atoms in the document.
 func (doc *Document) Length() int {
-	return int(doc.atoms.Len()) - 2
+	return doc.atoms.len() - 2
 }
 
 // Data returns all the atom data currently in the document, in order.
@@ -59,38 +112,107 @@ func (doc *Document) Data() []string {
 
 // Insert  adds a new atom with position `pos` and content `data`.
 //
-// Returns false if `pos` already exists in the document (and in that case, adds
-// nothing)
+// Returns false if `pos` already exists in the document, is of another shape,
+// or is not valid (see `position.Position.Validate`); and in that case, adds
+// nothing.
+//
+// Also returns false, adding nothing, if `pos` was deleted; including when the
+// deletion was received first.
 func (doc *Document) Insert(pos *position.Position, data string) bool {
+	if !doc.fits(pos) || pos.Validate() != nil {
+		return false
+	}
 	a := newAtom(pos, data)
-	res := doc.atoms.Insert(a)
-	return len(res) == 0
+	if doc.atoms.get(pos) != nil || doc.tombs.Get(a)[0] != nil {
+		return false
+	}
+	doc.atoms = doc.atoms.insert(a)
+	if len(doc.subs) > 0 {
+		idx, _ := doc.search(pos)
+		doc.emit(Inserted{idx, pos, data})
+	}
+	return true
 }
 
 // Delete removes the atom referenced `pos` from the document.
 //
 // Returns true iff the position was present.
+//
+// Either way, `pos` is kept as a tombstone: later insertions at `pos` are
+// ignored, and the document does not allocate it again. So replicas converge
+// whatever the order in which they receive insertions and deletions, eg. when
+// patches are reordered in transit; and an atom never takes the position of a
+// deleted one, which a concurrent deletion of the latter would delete, and
+// whose insertion would have the same ID as an earlier one (see `Patch.ID`).
+// The cost is memory, and snapshot size, growing with each deletion.
 func (doc *Document) Delete(pos *position.Position) bool {
+	if !doc.fits(pos) || pos.Validate() != nil {
+		return false
+	}
 	a := atom{pos: pos}
-	res := doc.atoms.Delete(&a)
-	return len(res) == 1
+	idx := -1
+	if len(doc.subs) > 0 {
+		idx, _ = doc.search(pos)
+	}
+	var del *atom
+	doc.atoms, del = doc.atoms.delete(pos)
+	doc.tombs.Insert(&a)
+	if del == nil {
+		return false
+	}
+	if len(doc.subs) > 0 {
+		doc.emit(Deleted{idx, del.pos, del.data})
+	}
+	return true
+}
+
+// Return the data of the atom at `pos`, and whether there is one; and whether
+// `pos` has a tombstone.
+func (doc *Document) lookup(pos *position.Position) (data string, present bool, deleted bool) {
+	if a := doc.atoms.get(pos); a != nil {
+		return a.data, true, false
+	}
+	return "", false, doc.tombs.Get(&atom{pos: pos})[0] != nil
+}
+
+// Tombstones returns the number of tombstones the document keeps, ie. of
+// positions deleted; see `Delete`.
+func (doc *Document) Tombstones() int {
+	return int(doc.tombs.Len()) - 1
+}
+
+// Applied returns true iff the patch identified `id` was applied to the
+// document.
+func (doc *Document) Applied(id PatchID) bool {
+	_, ok := doc.applied[id]
+	return ok
 }
 
 // Each iterates through atoms, passing them to the "cb" callback.
 // Skips the first and last "sentinel" atoms.
 func (doc *Document) Each(cb func(number uint, pos *position.Position, data string)) {
-	head := doc.atoms.ByPosition(1)
-	n := doc.Length()
-	if head == nil {
-		return
-	}
-	iter := doc.atoms.Iter(head)
-	for k := 0; k < n; k++ {
-		iter.Next()
-		a := iter.Value().(*atom)
-		// fmt.Println("iter:", k, a.pos, a.data)
-		cb(uint(k), a.pos, a.data)
-	}
+	k := uint(0)
+	doc.each(func(a *atom) {
+		cb(k, a.pos, a.data)
+		k++
+	})
+}
+
+func (doc *Document) each(cb func(*atom)) {
+	eachAtom(doc.atoms, cb)
+}
+
+// Call `cb` with the atoms of `atoms`, in order, skipping sentinels.
+func eachAtom(atoms *node, cb func(*atom)) {
+	n := atoms.len() - 2
+	atoms.each(1, func(a *atom) bool {
+		if n == 0 {
+			return false
+		}
+		cb(a)
+		n--
+		return true
+	})
 }
 
 // At returns the atom indexed `idx`.
@@ -99,30 +221,98 @@ func (doc *Document) At(idx int) (*position.Position, string) {
 		panic("index out of bounds")
 	}
 
-	a := doc.atoms.ByPosition(uint64(idx + 1)).(*atom)
+	a := doc.atoms.at(idx + 1)
 	return a.pos, a.data
 }
 
+// Return a position immediately after `pos`, which is not an atom of the
+// document: before the atoms and tombstones that follow it.
+func (doc *Document) allocateAfter(pos *position.Position, site uid.Uid) (*position.Position, error) {
+	a := &atom{pos: pos}
+	_, right := doc.atoms.search(pos)
+	// the first tombstone after `pos`, if any
+	if t, k := doc.tombs.GetWithPosition(a); t != nil {
+		if t.Compare(a) == 0 {
+			k++
+		}
+		if k < doc.tombs.Len() {
+			if t := doc.tombs.ByPosition(k).(*atom); t.pos.IsBefore(right.pos) {
+				right = t
+			}
+		}
+	}
+
+	out := new(position.Position)
+	if err := doc.alloc.Call(out, pos, right.pos, site); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IndexOf returns the index of the atom at `pos`, and true; or false if there
+// is none, eg. as it was deleted. Takes O(log n) time.
+func (doc *Document) IndexOf(pos *position.Position) (int, bool) {
+	return doc.Snapshot().IndexOf(pos)
+}
+
+// Nearest returns the index of the atom at `pos` or, if there is none, of the
+// first atom after it, or else of the last atom; eg. to show a comment on a
+// line that was deleted since. Takes O(log n) time.
+//
+// Returns -1 if the document is empty, or `pos` is of another shape.
+func (doc *Document) Nearest(pos *position.Position) int {
+	return doc.Snapshot().Nearest(pos)
+}
+
+// Return the index of the first atom at or after `pos`, and the atom; -1 for
+// the head sentinel, and `Length()` for the tail one. Returns past the tail,
+// and a nil atom, for invalid positions after it.
+func (doc *Document) search(pos *position.Position) (int, *atom) {
+	idx, a := doc.atoms.search(pos)
+	return idx - 1, a
+}
+
 // Allocate returns positions ordered immediately before the atom at index `idx`.
-// The resulting slice is ordered.
-func (doc *Document) Allocate(idx int, count int, site uid.Uid) []*position.Position {
-	if debug && (idx < 0 || idx >= doc.Length()) {
+// The resulting slice is ordered, and spread evenly in the free room there.
+//
+// Returns `position.ErrExhausted` if there is no room left before that atom.
+func (doc *Document) Allocate(idx int, count int, site uid.Uid) ([]*position.Position, error) {
+	if debug && (idx < 0 || idx > doc.Length()) {
 		panic("index out of bounds")
 	}
+	return doc.allocateBetween(idx-1, idx, count, site)
+}
+
+// Return `count` ordered positions between the atoms indexed `lo` and `hi`,
+// using -1 and `Length()` for the sentinels.
+func (doc *Document) allocateBetween(lo int, hi int, count int, site uid.Uid) ([]*position.Position, error) {
+	return doc.allocate(doc.atoms.at(lo+1), doc.atoms.at(hi+1), count, site)
+}
+
+// Return `count` ordered positions between the atoms `left` and `right`, which
+// need not be in the document.
+func (doc *Document) allocate(left *atom, right *atom, count int, site uid.Uid) ([]*position.Position, error) {
 	if count < 0 {
 		panic("cannot allocate a negative number of positions")
 	}
 
 	out := make([]*position.Position, count)
+	for k := range out {
+		out[k] = new(position.Position)
+	}
 
-	left := doc.atoms.ByPosition(uint64(idx)).(*atom).pos
-	right := doc.atoms.ByPosition(uint64(idx + 1)).(*atom).pos
+	// allocate after the last tombstone before `right`, if any, so that
+	// positions with a tombstone are not allocated
+	idx := doc.tombs.Len()
+	if t, k := doc.tombs.GetWithPosition(right); t != nil {
+		idx = k
+	}
+	if t := doc.tombs.ByPosition(idx - 1).(*atom); left.pos.IsBefore(t.pos) {
+		left = t
+	}
 
-	for k := range out {
-		p := new(position.Position)
-		doc.alloc.Call(p, left, right, site)
-		out[k] = p
-		left = p
+	if err := doc.alloc.CallN(out, left.pos, right.pos, site); err != nil {
+		return nil, err
 	}
-	return out
+	return out, nil
 }
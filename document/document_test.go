@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
 	"github.com/mezis/lseq/uid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -30,19 +31,82 @@ var _ = Describe("lseq", func() {
 	Describe("Document.Allocate", func() {
 		x := NewDocument()
 		It("returns a slice of positions", func() {
-			res := x.Allocate(0, 10, site)
+			res, err := x.Allocate(0, 10, site)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(res).NotTo(Equal(nil))
 			Expect(len(res)).To(Equal(10))
 		})
 
 		It("returns ordered positions", func() {
 		})
+
+		It("keeps positions short for large pastes", func() {
+			doc := NewDocument()
+			res, err := doc.Allocate(0, 10000, site)
+			Expect(err).NotTo(HaveOccurred())
+			for _, p := range res {
+				Expect(p.Length()).To(Equal(3))
+			}
+		})
+
+		It("reports exhaustion", func() {
+			doc := NewDocument()
+			p1, _ := position.Parse("<1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1>")
+			p2, _ := position.Parse("<1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2>")
+			doc.Insert(p1, "foo")
+			doc.Insert(p2, "bar")
+
+			_, err := doc.Allocate(1, 1, site)
+			Expect(err).To(MatchError(position.ErrExhausted))
+		})
+	})
+
+	Describe("NewDocument with a seed", func() {
+		It("allocates reproducibly", func() {
+			edit := func() []string {
+				doc := NewDocument(WithAllocator(position.WithSeed(42)))
+				out := []string{}
+				for k := 0; k < 40; k++ {
+					pos, err := doc.Allocate(k/2, 1, site)
+					Expect(err).NotTo(HaveOccurred())
+					doc.Insert(pos[0], "foo")
+					out = append(out, pos[0].String())
+				}
+				return out
+			}
+			Expect(edit()).To(Equal(edit()))
+		})
+	})
+
+	Describe("NewDocument with a shape", func() {
+		shape := position.TreeShape{RootBits: 10, Growth: 2, MaxDigits: 10}
+
+		It("allocates positions of that shape", func() {
+			doc := NewDocument(WithAllocator(position.WithShape(shape)))
+			Expect(doc.Shape()).To(Equal(shape))
+			pos, err := doc.Allocate(0, 10, site)
+			Expect(err).NotTo(HaveOccurred())
+			for _, p := range pos {
+				Expect(p.Shape().Compatible(shape)).To(BeTrue())
+				Expect(doc.Insert(p, "foo")).To(BeTrue())
+			}
+			Expect(doc.Length()).To(Equal(10))
+		})
+
+		It("refuses positions of other shapes", func() {
+			doc := NewDocument(WithAllocator(position.WithShape(shape)))
+			other := NewDocument()
+			pos, _ := other.Allocate(0, 1, site)
+			Expect(doc.Insert(pos[0], "foo")).To(BeFalse())
+			Expect(doc.Delete(pos[0])).To(BeFalse())
+			Expect(doc.Length()).To(Equal(0))
+		})
 	})
 
-	buildDocument := func() *Document {
+	buildDocument := func(opts ...Option) *Document {
 		data := []string{"foo", "bar", "qux"}
-		out := NewDocument()
-		pos := out.Allocate(0, len(data), site)
+		out := NewDocument(opts...)
+		pos, _ := out.Allocate(0, len(data), site)
 		for k, s := range data {
 			out.Insert(pos[k], s)
 		}
@@ -58,6 +122,93 @@ var _ = Describe("lseq", func() {
 		})
 	})
 
+	Describe("Document.IndexOf", func() {
+		It("returns the index of positions", func() {
+			doc := buildDocument()
+			for k := 0; k < doc.Length(); k++ {
+				p, _ := doc.At(k)
+				idx, ok := doc.IndexOf(p)
+				Expect(ok).To(BeTrue())
+				Expect(idx).To(Equal(k))
+			}
+		})
+
+		It("returns the index of positions in large documents", func() {
+			doc := NewDocument(WithAllocator(position.WithSeed(1)))
+			pos, err := doc.Allocate(0, 1000, site)
+			Expect(err).NotTo(HaveOccurred())
+			for k := len(pos) - 1; k >= 0; k -= 2 {
+				doc.Insert(pos[k], "")
+			}
+			for k := 0; k < doc.Length(); k++ {
+				p, _ := doc.At(k)
+				idx, _ := doc.IndexOf(p)
+				Expect(idx).To(Equal(k))
+			}
+		})
+
+		It("returns false for positions not in the document", func() {
+			doc := buildDocument()
+			p, _ := doc.Allocate(1, 1, site)
+			_, ok := doc.IndexOf(p[0])
+			Expect(ok).To(BeFalse())
+
+			q, _ := doc.At(1)
+			doc.Delete(q)
+			_, ok = doc.IndexOf(q)
+			Expect(ok).To(BeFalse())
+
+			for _, s := range []string{"<0>", "<31>", "<31, 1>"} {
+				p, _ := position.Parse(s)
+				_, ok = doc.IndexOf(p)
+				Expect(ok).To(BeFalse(), s)
+			}
+		})
+
+		It("returns false for positions of other shapes", func() {
+			doc := buildDocument()
+			p := position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10}.New().Append(1, site)
+			_, ok := doc.IndexOf(p)
+			Expect(ok).To(BeFalse())
+			Expect(doc.Nearest(p)).To(Equal(-1))
+		})
+	})
+
+	Describe("Document.Nearest", func() {
+		It("returns the index of positions", func() {
+			doc := buildDocument()
+			p, _ := doc.At(1)
+			Expect(doc.Nearest(p)).To(Equal(1))
+		})
+
+		It("returns the index of the next atom for deleted positions", func() {
+			doc := buildDocument()
+			p, _ := doc.At(1)
+			doc.Delete(p)
+			Expect(doc.Nearest(p)).To(Equal(1))
+			q, _ := doc.At(0)
+			doc.Delete(q)
+			Expect(doc.Nearest(q)).To(Equal(0))
+		})
+
+		It("returns the index of the last atom past the end", func() {
+			doc := buildDocument()
+			p, _ := doc.At(2)
+			doc.Delete(p)
+			Expect(doc.Nearest(p)).To(Equal(1))
+		})
+
+		It("returns -1 for empty documents", func() {
+			doc := buildDocument()
+			p, _ := doc.At(1)
+			for doc.Length() > 0 {
+				q, _ := doc.At(0)
+				doc.Delete(q)
+			}
+			Expect(doc.Nearest(p)).To(Equal(-1))
+		})
+	})
+
 	Describe("Document.Insert", func() {
 		It("increases the atom count", func() {
 			doc := buildDocument()
@@ -69,7 +220,28 @@ var _ = Describe("lseq", func() {
 			Expect(doc.Data()).To(Equal([]string{"foo", "bar", "qux"}))
 		})
 
-		XIt("returns false if the atom already existed", func() {})
+		It("returns false if the atom already existed", func() {
+			doc := buildDocument()
+			p, _ := doc.At(1)
+			Expect(doc.Insert(p, "other")).To(BeFalse())
+			Expect(doc.Data()).To(Equal([]string{"foo", "bar", "qux"}))
+		})
+
+		It("returns true for new atoms", func() {
+			doc := buildDocument()
+			p, _ := doc.Allocate(1, 1, site)
+			Expect(doc.Insert(p[0], "baz")).To(BeTrue())
+			Expect(doc.Data()).To(Equal([]string{"foo", "baz", "bar", "qux"}))
+		})
+
+		It("returns false for invalid positions", func() {
+			doc := buildDocument()
+			for _, s := range []string{"<0>", "<31>", "<31, 1>"} {
+				p, _ := position.Parse(s)
+				Expect(doc.Insert(p, "bad")).To(BeFalse(), s)
+			}
+			Expect(doc.Data()).To(Equal([]string{"foo", "bar", "qux"}))
+		})
 	})
 	Describe("Document.Delete", func() {
 		perform := func() (*Document, interface{}) {
@@ -93,7 +265,56 @@ var _ = Describe("lseq", func() {
 			Expect(doc.Data()).To(Equal([]string{"foo", "qux"}))
 		})
 
-		XIt("returns false when the item didn't exist", func() {})
+		It("returns false when the item didn't exist", func() {
+			doc := buildDocument()
+			p, _ := doc.Allocate(1, 1, site)
+			Expect(doc.Delete(p[0])).To(BeFalse())
+			Expect(doc.Length()).To(Equal(3))
+		})
+
+		It("ignores later insertions of deleted items", func() {
+			doc := buildDocument()
+			p, _ := doc.At(1)
+			doc.Delete(p)
+			Expect(doc.Tombstones()).To(Equal(1))
+			Expect(doc.Insert(p, "bar")).To(BeFalse())
+			Expect(doc.Insert(p, "bar")).To(BeFalse())
+			Expect(doc.Data()).To(Equal([]string{"foo", "qux"}))
+		})
+
+		It("ignores insertions of items deleted before they were inserted", func() {
+			doc := buildDocument()
+			p, _ := doc.Allocate(1, 1, site)
+			doc.Delete(p[0])
+			Expect(doc.Tombstones()).To(Equal(1))
+			Expect(doc.Insert(p[0], "baz")).To(BeFalse())
+			Expect(doc.Data()).To(Equal([]string{"foo", "bar", "qux"}))
+			Expect(doc.Insert(p[0], "baz")).To(BeFalse())
+		})
+
+		It("does not allocate deleted positions again", func() {
+			doc := buildDocument()
+			deleted := map[string]bool{}
+			for k := 0; k < 100; k++ {
+				p, err := doc.Allocate(1, 2, site)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range p {
+					Expect(deleted).NotTo(HaveKey(q.String()))
+					deleted[q.String()] = true
+					Expect(doc.Insert(q, "baz")).To(BeTrue())
+					Expect(doc.Delete(q)).To(BeTrue())
+				}
+			}
+			Expect(doc.Data()).To(Equal([]string{"foo", "bar", "qux"}))
+		})
+
+		It("does not delete sentinels", func() {
+			doc := buildDocument()
+			Expect(doc.Delete(position.SentinelHead)).To(BeFalse())
+			Expect(doc.Delete(position.SentinelTail)).To(BeFalse())
+			Expect(doc.Tombstones()).To(Equal(0))
+			Expect(doc.Length()).To(Equal(3))
+		})
 	})
 
 	Describe("Document.Each", func() {
@@ -105,7 +326,8 @@ func BenchmarkDocumentRandomEdits(b *testing.B) {
 	for _, exp := range []uint{10, 11, 12, 13, 14, 15, 16} {
 		count := 1 << exp
 		doc := NewDocument()
-		for k, pos := range doc.Allocate(0, count, 0x00) {
+		positions, _ := doc.Allocate(0, count, 0x00)
+		for k, pos := range positions {
 			str := fmt.Sprintf("atom%04d", k)
 			doc.Insert(pos, str)
 		}
@@ -120,7 +342,7 @@ func BenchmarkDocumentRandomEdits(b *testing.B) {
 				n := rand.Intn(doc.Length())
 				p, _ := doc.At(n)
 				str := fmt.Sprintf("edit%05d", k)
-				q := doc.Allocate(n, 1, 0x00)
+				q, _ := doc.Allocate(n, 1, 0x00)
 				doc.Delete(p)
 				doc.Insert(q[0], str)
 			}
@@ -0,0 +1,480 @@
+package document
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+)
+
+// Version of the binary and JSON encodings of patches.
+//
+// Binary layout:
+//
+//	version   byte
+//	site      8 bytes, big-endian
+//	nonce     8 bytes, big-endian; see `Patch.ID`
+//	count     uvarint, number of items
+//	items     once per item:
+//	            op        byte, 0 for deletions and 1 for insertions
+//	            position  uvarint length, then the position in version 1 of its
+//	                      binary encoding; see `positionEncodingVersion`
+//	            data      uvarint length, then bytes
+//	checksum  4 bytes, big-endian CRC-32 (IEEE) of all preceding bytes
+//
+// The JSON encoding is an object with `version`; `site` and `nonce`, in
+// hexadecimal; `items` (each an object with `op`, "insert" or "delete"; `pos`, in the format
+// of `position.Position.String`; and `data`); and `checksum`, the CRC-32 of the
+// binary encoding of the same patch.
+const patchEncodingVersion = 1
+
+// Version of the binary encoding of the positions embedded in encodings of
+// patches and presence updates, and so covered by their checksums; including
+// the checksums of JSON encodings. Pinned, rather than the latest version
+// written by `position.Position.MarshalBinary`, so that these encodings and
+// their checksums don't change when positions move to a later version.
+const positionEncodingVersion = 1
+
+// ErrTruncated is returned when decoding input that ends prematurely.
+var ErrTruncated = errors.New("document: truncated input")
+
+// ErrMalformed is returned when decoding input that is structurally invalid
+// (unknown operations, trailing bytes).
+var ErrMalformed = errors.New("document: malformed input")
+
+// ErrChecksum is returned when decoding input whose checksum does not match
+// its contents.
+var ErrChecksum = errors.New("document: checksum mismatch")
+
+// VersionError is returned when decoding input written in an unknown
+// encoding version.
+type VersionError uint8
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("document: unknown encoding version %d", uint8(e))
+}
+
+// MarshalBinary --
+// Implement `encoding.BinaryMarshaler`.
+func (p *Patch) MarshalBinary() ([]byte, error) {
+	return p.marshalBinary(), nil
+}
+
+func (p *Patch) marshalBinary() []byte {
+	out := []byte{patchEncodingVersion}
+	out = binary.BigEndian.AppendUint64(out, uint64(p.site))
+	out = binary.BigEndian.AppendUint64(out, p.nonce)
+	out = p.appendItems(out)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// Append the count of items, and the items, to `out`.
+func (p *Patch) appendItems(out []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(len(p.items)))
+	for _, i := range p.items {
+		op := byte(0)
+		if i.op == OpInsert {
+			op = 1
+		}
+		out = append(out, op)
+
+		out = appendPosition(out, i.pos)
+
+		out = binary.AppendUvarint(out, uint64(len(i.data)))
+		out = append(out, i.data...)
+	}
+	return out
+}
+
+// Append the length of the encoding of `pos`, then the encoding, to `out`.
+func appendPosition(out []byte, pos *position.Position) []byte {
+	buf, _ := pos.MarshalBinaryVersion(positionEncodingVersion)
+	out = binary.AppendUvarint(out, uint64(len(buf)))
+	return append(out, buf...)
+}
+
+// UnmarshalBinary --
+// Implement `encoding.BinaryUnmarshaler`.
+func (p *Patch) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+	if version := data[0]; version != patchEncodingVersion {
+		return VersionError(version)
+	}
+	if len(data) < 5 {
+		return ErrTruncated
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return ErrChecksum
+	}
+	data = body[1:]
+
+	if len(data) < 16 {
+		return ErrTruncated
+	}
+	site := uid.Uid(binary.BigEndian.Uint64(data))
+	nonce := binary.BigEndian.Uint64(data[8:])
+	data = data[16:]
+
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	// each item takes at least 3 bytes
+	if count > uint64(len(data))/3 {
+		return ErrMalformed
+	}
+
+	items := make([]Item, count)
+	for k := range items {
+		if len(data) < 1 {
+			return ErrTruncated
+		}
+		switch data[0] {
+		case 0:
+			items[k].op = OpDelete
+		case 1:
+			items[k].op = OpInsert
+		default:
+			return ErrMalformed
+		}
+		data = data[1:]
+
+		var buf []byte
+		if buf, data, err = readBytes(data); err != nil {
+			return err
+		}
+		items[k].pos = new(position.Position)
+		if err = items[k].pos.UnmarshalBinary(buf); err != nil {
+			return err
+		}
+
+		if buf, data, err = readBytes(data); err != nil {
+			return err
+		}
+		items[k].data = string(buf)
+	}
+	if len(data) > 0 {
+		return ErrMalformed
+	}
+
+	p.site = site
+	p.nonce = nonce
+	p.items = items
+	return nil
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	val, n := binary.Uvarint(data)
+	if n == 0 {
+		return 0, data, ErrTruncated
+	}
+	if n < 0 {
+		return 0, data, ErrMalformed
+	}
+	return val, data[n:], nil
+}
+
+// Read a uvarint length, then as many bytes.
+func readBytes(data []byte) ([]byte, []byte, error) {
+	length, data, err := readUvarint(data)
+	if err != nil {
+		return nil, data, err
+	}
+	if length > uint64(len(data)) {
+		return nil, data, ErrTruncated
+	}
+	return data[:length], data[length:], nil
+}
+
+type jsonItem struct {
+	Op   string             `json:"op"`
+	Pos  *position.Position `json:"pos"`
+	Data string             `json:"data"`
+}
+
+type jsonPatch struct {
+	Version  uint8      `json:"version"`
+	Site     string     `json:"site"`
+	Nonce    string     `json:"nonce"`
+	Items    []jsonItem `json:"items"`
+	Checksum uint32     `json:"checksum"`
+}
+
+// Return the checksum of the binary encoding of `p`.
+func (p *Patch) checksum() uint32 {
+	buf := p.marshalBinary()
+	return binary.BigEndian.Uint32(buf[len(buf)-4:])
+}
+
+// MarshalJSON --
+// Implement `json.Marshaler`.
+func (p *Patch) MarshalJSON() ([]byte, error) {
+	out := jsonPatch{
+		Version: patchEncodingVersion,
+		Site:    p.site.String(),
+		Nonce:   fmt.Sprintf("%X", p.nonce),
+		Items:   make([]jsonItem, len(p.items)),
+	}
+	for k, i := range p.items {
+		op := "delete"
+		if i.op == OpInsert {
+			op = "insert"
+		}
+		out.Items[k] = jsonItem{Op: op, Pos: i.pos, Data: i.data}
+	}
+
+	out.Checksum = p.checksum()
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON --
+// Implement `json.Unmarshaler`.
+func (p *Patch) UnmarshalJSON(data []byte) error {
+	var in jsonPatch
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Version != patchEncodingVersion {
+		return VersionError(in.Version)
+	}
+
+	site, err := strconv.ParseUint(in.Site, 16, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	nonce, err := strconv.ParseUint(in.Nonce, 16, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	out := &Patch{site: uid.Uid(site), nonce: nonce, items: make([]Item, len(in.Items))}
+	for k, i := range in.Items {
+		switch i.Op {
+		case "delete":
+			out.items[k].op = OpDelete
+		case "insert":
+			out.items[k].op = OpInsert
+		default:
+			return ErrMalformed
+		}
+		if i.Pos == nil {
+			return ErrMalformed
+		}
+		out.items[k].pos = i.Pos
+		out.items[k].data = i.Data
+	}
+
+	if out.checksum() != in.Checksum {
+		return ErrChecksum
+	}
+
+	p.site = out.site
+	p.nonce = out.nonce
+	p.items = out.items
+	return nil
+}
+
+// Version of the binary and JSON encodings of presence updates.
+//
+// Binary layout:
+//
+//	version    byte
+//	site       8 bytes, big-endian
+//	epoch      8 bytes, big-endian
+//	seq        uvarint
+//	present    byte, 1 if a selection follows, 0 if the peer left
+//	selection  if present, its anchor then its head, each:
+//	             gravity   byte, 0 for left and 1 for right
+//	             position  uvarint length, then the position in version 1 of
+//	                       its binary encoding; see `positionEncodingVersion`
+//	checksum   4 bytes, big-endian CRC-32 (IEEE) of all preceding bytes
+//
+// The JSON encoding is an object with `version`; `site` and `epoch`, in
+// hexadecimal; `seq`;
+// `selection`, null or an object with `anchor` and `head` (each an object with
+// `pos`, in the format of `position.Position.String`; and `gravity`, "left" or
+// "right"); and `checksum`, the CRC-32 of the binary encoding of the same
+// update.
+const presenceEncodingVersion = 1
+
+// MarshalBinary --
+// Implement `encoding.BinaryMarshaler`.
+func (u *PresenceUpdate) MarshalBinary() ([]byte, error) {
+	out := []byte{presenceEncodingVersion}
+	out = binary.BigEndian.AppendUint64(out, uint64(u.Site))
+	out = binary.BigEndian.AppendUint64(out, u.Epoch)
+	out = binary.AppendUvarint(out, u.Seq)
+	if u.Selection == nil {
+		out = append(out, 0)
+	} else {
+		out = append(out, 1)
+		for _, c := range []Cursor{u.Selection.Anchor, u.Selection.Head} {
+			out = append(out, byte(c.Gravity))
+			out = appendPosition(out, c.Pos)
+		}
+	}
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out)), nil
+}
+
+// UnmarshalBinary --
+// Implement `encoding.BinaryUnmarshaler`.
+func (u *PresenceUpdate) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+	if version := data[0]; version != presenceEncodingVersion {
+		return VersionError(version)
+	}
+	if len(data) < 5 {
+		return ErrTruncated
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return ErrChecksum
+	}
+	data = body[1:]
+
+	if len(data) < 16 {
+		return ErrTruncated
+	}
+	out := PresenceUpdate{
+		Site:  uid.Uid(binary.BigEndian.Uint64(data)),
+		Epoch: binary.BigEndian.Uint64(data[8:]),
+	}
+	seq, data, err := readUvarint(data[16:])
+	if err != nil {
+		return err
+	}
+	out.Seq = seq
+
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+	switch data[0] {
+	case 0:
+		data = data[1:]
+	case 1:
+		data = data[1:]
+		var ends [2]Cursor
+		for k := range ends {
+			if len(data) < 1 {
+				return ErrTruncated
+			}
+			if ends[k].Gravity = Gravity(data[0]); ends[k].Gravity > GravityRight {
+				return ErrMalformed
+			}
+			var buf []byte
+			if buf, data, err = readBytes(data[1:]); err != nil {
+				return err
+			}
+			ends[k].Pos = new(position.Position)
+			if err = ends[k].Pos.UnmarshalBinary(buf); err != nil {
+				return err
+			}
+		}
+		out.Selection = &Selection{Anchor: ends[0], Head: ends[1]}
+	default:
+		return ErrMalformed
+	}
+	if len(data) > 0 {
+		return ErrMalformed
+	}
+
+	*u = out
+	return nil
+}
+
+type jsonCursor struct {
+	Pos     *position.Position `json:"pos"`
+	Gravity string             `json:"gravity"`
+}
+
+type jsonSelection struct {
+	Anchor jsonCursor `json:"anchor"`
+	Head   jsonCursor `json:"head"`
+}
+
+type jsonPresenceUpdate struct {
+	Version   uint8          `json:"version"`
+	Site      string         `json:"site"`
+	Epoch     string         `json:"epoch"`
+	Seq       uint64         `json:"seq"`
+	Selection *jsonSelection `json:"selection"`
+	Checksum  uint32         `json:"checksum"`
+}
+
+// MarshalJSON --
+// Implement `json.Marshaler`.
+func (u *PresenceUpdate) MarshalJSON() ([]byte, error) {
+	out := jsonPresenceUpdate{
+		Version: presenceEncodingVersion,
+		Site:    u.Site.String(),
+		Epoch:   fmt.Sprintf("%X", u.Epoch),
+		Seq:     u.Seq,
+	}
+	if u.Selection != nil {
+		out.Selection = &jsonSelection{
+			Anchor: jsonCursor{u.Selection.Anchor.Pos, u.Selection.Anchor.Gravity.String()},
+			Head:   jsonCursor{u.Selection.Head.Pos, u.Selection.Head.Gravity.String()},
+		}
+	}
+
+	buf, _ := u.MarshalBinary()
+	out.Checksum = binary.BigEndian.Uint32(buf[len(buf)-4:])
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON --
+// Implement `json.Unmarshaler`.
+func (u *PresenceUpdate) UnmarshalJSON(data []byte) error {
+	var in jsonPresenceUpdate
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Version != presenceEncodingVersion {
+		return VersionError(in.Version)
+	}
+
+	site, err := strconv.ParseUint(in.Site, 16, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	epoch, err := strconv.ParseUint(in.Epoch, 16, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	out := PresenceUpdate{Site: uid.Uid(site), Epoch: epoch, Seq: in.Seq}
+	if in.Selection != nil {
+		var ends [2]Cursor
+		for k, c := range []jsonCursor{in.Selection.Anchor, in.Selection.Head} {
+			switch c.Gravity {
+			case "left":
+				ends[k].Gravity = GravityLeft
+			case "right":
+				ends[k].Gravity = GravityRight
+			default:
+				return ErrMalformed
+			}
+			if c.Pos == nil {
+				return ErrMalformed
+			}
+			ends[k].Pos = c.Pos
+		}
+		out.Selection = &Selection{Anchor: ends[0], Head: ends[1]}
+	}
+
+	buf, _ := out.MarshalBinary()
+	if binary.BigEndian.Uint32(buf[len(buf)-4:]) != in.Checksum {
+		return ErrChecksum
+	}
+
+	*u = out
+	return nil
+}
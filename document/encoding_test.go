@@ -0,0 +1,207 @@
+package document_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/")
+
+var _ = Describe("Patch encoding", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	// Patches building a document, then editing it, as produced by
+	// `NewPatch`.
+	states := [][]string{
+		{"hello", "beautiful", "world"},
+		{"hello", "frabjous", "world", "!"},
+	}
+	buildPatches := func() []*Patch {
+		doc := NewDocument(WithAllocator(position.WithSeed(1)))
+		out := []*Patch{}
+		for _, data := range states {
+			p, err := NewPatch(doc, site, data)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			out = append(out, p)
+		}
+		return out
+	}
+
+	Describe("MarshalBinary", func() {
+		It("round-trips", func() {
+			for _, p := range buildPatches() {
+				buf, err := p.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				q := new(Patch)
+				Expect(q.UnmarshalBinary(buf)).To(Succeed())
+				Expect(q.String()).To(Equal(p.String()))
+				Expect(q.ID()).To(Equal(p.ID()))
+			}
+		})
+
+		It("round-trips positions of other shapes", func() {
+			doc := NewDocument(WithAllocator(position.WithShape(position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10})))
+			p, _ := NewPatch(doc, site, []string{"hello"})
+			buf, _ := p.MarshalBinary()
+			q := new(Patch)
+			Expect(q.UnmarshalBinary(buf)).To(Succeed())
+			_, err := q.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(doc.Data()).To(Equal([]string{"hello"}))
+		})
+	})
+
+	Describe("UnmarshalBinary", func() {
+		var buf []byte
+		BeforeEach(func() {
+			buf, _ = buildPatches()[1].MarshalBinary()
+		})
+
+		It("rejects empty input", func() {
+			Expect(new(Patch).UnmarshalBinary(nil)).To(MatchError(ErrTruncated))
+		})
+
+		It("rejects unknown versions", func() {
+			buf[0] = 42
+			Expect(new(Patch).UnmarshalBinary(buf)).To(Equal(VersionError(42)))
+		})
+
+		It("rejects truncated input", func() {
+			for n := 1; n < len(buf); n++ {
+				Expect(new(Patch).UnmarshalBinary(buf[:n])).NotTo(Succeed())
+			}
+		})
+
+		It("rejects corrupted input", func() {
+			for n := 1; n < len(buf); n++ {
+				corrupt := append([]byte{}, buf...)
+				corrupt[n] ^= 0x10
+				Expect(new(Patch).UnmarshalBinary(corrupt)).To(MatchError(ErrChecksum))
+			}
+		})
+
+		It("leaves the patch untouched on errors", func() {
+			p := buildPatches()[0]
+			before := p.String()
+			Expect(p.UnmarshalBinary(buf[:len(buf)-1])).NotTo(Succeed())
+			Expect(p.String()).To(Equal(before))
+		})
+	})
+
+	Describe("MarshalJSON", func() {
+		It("round-trips", func() {
+			for _, p := range buildPatches() {
+				buf, err := json.Marshal(p)
+				Expect(err).NotTo(HaveOccurred())
+				q := new(Patch)
+				Expect(json.Unmarshal(buf, q)).To(Succeed())
+				Expect(q.String()).To(Equal(p.String()))
+				Expect(q.ID()).To(Equal(p.ID()))
+			}
+		})
+
+		It("checksums positions in version 1 of their encoding", func() {
+			pos, _ := NewDocument().Allocate(0, 1, site)
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[0], "hello"))
+
+			var out struct {
+				Nonce    string
+				Checksum uint32
+			}
+			buf, _ := json.Marshal(p)
+			Expect(json.Unmarshal(buf, &out)).To(Succeed())
+			nonce, err := strconv.ParseUint(out.Nonce, 16, 64)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the binary encoding of version 1 patches, whatever the latest
+			// encoding of positions
+			enc, err := pos[0].MarshalBinaryVersion(1)
+			Expect(err).NotTo(HaveOccurred())
+			want := binary.BigEndian.AppendUint64([]byte{1}, uint64(site))
+			want = binary.BigEndian.AppendUint64(want, nonce)
+			want = append(want, 1, 1, byte(len(enc)))
+			want = append(want, enc...)
+			want = append(want, 5)
+			want = append(want, "hello"...)
+			Expect(out.Checksum).To(Equal(crc32.ChecksumIEEE(want)))
+		})
+
+		It("rejects checksum mismatches", func() {
+			buf, _ := json.Marshal(buildPatches()[0])
+			buf = bytes.Replace(buf, []byte("beautiful"), []byte("wonderful"), 1)
+			Expect(json.Unmarshal(buf, new(Patch))).To(MatchError(ErrChecksum))
+		})
+
+		It("rejects unknown operations", func() {
+			buf, _ := json.Marshal(buildPatches()[0])
+			buf = bytes.Replace(buf, []byte(`"insert"`), []byte(`"upsert"`), 1)
+			Expect(json.Unmarshal(buf, new(Patch))).To(MatchError(ErrMalformed))
+		})
+
+		It("rejects malformed sites", func() {
+			buf, _ := json.Marshal(buildPatches()[0])
+			buf = bytes.Replace(buf, []byte(`"F00F00F0"`), []byte(`"F00F00FG"`), 1)
+			Expect(json.Unmarshal(buf, new(Patch))).To(MatchError(ErrMalformed))
+		})
+
+		It("rejects unknown versions", func() {
+			Expect(json.Unmarshal([]byte(`{"version":42}`), new(Patch))).To(Equal(VersionError(42)))
+		})
+	})
+
+	Describe("golden files", func() {
+		path := func(k int, name string) string {
+			return filepath.Join("testdata", fmt.Sprintf("patch-v1-%c.%s", 'a'+k, name))
+		}
+
+		golden := func(name string, encode func(*Patch) ([]byte, error), decode func(*Patch, []byte) error) {
+			It("decodes "+name+" patches from testdata", func() {
+				patches := buildPatches()
+				doc := NewDocument()
+				for k, p := range patches {
+					want, err := encode(p)
+					Expect(err).NotTo(HaveOccurred())
+					if *update {
+						Expect(os.WriteFile(path(k, name), want, 0644)).To(Succeed())
+					}
+
+					buf, err := os.ReadFile(path(k, name))
+					Expect(err).NotTo(HaveOccurred())
+					q := new(Patch)
+					Expect(decode(q, buf)).To(Succeed())
+					Expect(q.Site()).To(Equal(site))
+					Expect(q.ID()).To(Equal(p.ID()))
+					_, err = q.Apply(doc)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(doc.Data()).To(Equal(states[k]))
+
+					// encoding is stable
+					Expect(encode(q)).To(Equal(buf))
+				}
+			})
+		}
+
+		golden("bin", (*Patch).MarshalBinary, (*Patch).UnmarshalBinary)
+		golden("json", func(p *Patch) ([]byte, error) {
+			return json.MarshalIndent(p, "", "  ")
+		}, func(p *Patch, buf []byte) error {
+			return json.Unmarshal(buf, p)
+		})
+	})
+})
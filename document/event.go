@@ -0,0 +1,59 @@
+package document
+
+import "github.com/mezis/lseq/position"
+
+// Event is a change to a document, passed to subscribers; either `Inserted`
+// or `Deleted`.
+type Event interface {
+	event()
+}
+
+// Inserted -
+// An atom was inserted, and is now at `Index`.
+type Inserted struct {
+	Index int
+	Pos   *position.Position
+	Data  string
+}
+
+// Deleted -
+// An atom was deleted, from `Index`.
+type Deleted struct {
+	Index int
+	Pos   *position.Position
+	Data  string
+}
+
+func (Inserted) event() {}
+func (Deleted) event()  {}
+
+type subscription struct {
+	cb func(Event)
+}
+
+// Subscribe -
+// Call `cb` with each later change to the document, whether made by `Insert`
+// and `Delete`, or by applying patches; so that views can follow them rather
+// than reading the whole document again.
+//
+// `cb` is called synchronously, once the change is made; and must not change
+// the document. Returns a function cancelling the subscription.
+func (doc *Document) Subscribe(cb func(Event)) (cancel func()) {
+	s := &subscription{cb}
+	doc.subs = append(doc.subs[:len(doc.subs):len(doc.subs)], s)
+	return func() {
+		subs := make([]*subscription, 0, len(doc.subs))
+		for _, t := range doc.subs {
+			if t != s {
+				subs = append(subs, t)
+			}
+		}
+		doc.subs = subs
+	}
+}
+
+func (doc *Document) emit(e Event) {
+	for _, s := range doc.subs {
+		s.cb(e)
+	}
+}
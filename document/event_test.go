@@ -0,0 +1,114 @@
+package document_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Document.Subscribe", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	var (
+		doc    *Document
+		pos    []*position.Position
+		events []Event
+	)
+	BeforeEach(func() {
+		doc = NewDocument()
+		pos, _ = doc.Allocate(0, 3, site)
+		doc.Insert(pos[0], "hello")
+		doc.Insert(pos[2], "world")
+		events = nil
+		doc.Subscribe(func(e Event) {
+			events = append(events, e)
+		})
+	})
+
+	It("reports insertions", func() {
+		Expect(doc.Insert(pos[1], "beautiful")).To(BeTrue())
+		Expect(events).To(Equal([]Event{Inserted{1, pos[1], "beautiful"}}))
+	})
+
+	It("reports deletions", func() {
+		Expect(doc.Delete(pos[2])).To(BeTrue())
+		Expect(events).To(Equal([]Event{Deleted{1, pos[2], "world"}}))
+	})
+
+	It("reports nothing when nothing changes", func() {
+		doc.Insert(pos[0], "hello")
+		doc.Delete(pos[1])
+		doc.Insert(pos[1], "beautiful")
+		Expect(events).To(BeEmpty())
+	})
+
+	It("reports changes from patches", func() {
+		p, _ := NewPatch(doc, site, []string{"hello", "frabjous", "world", "!"})
+		_, err := p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		Expect(events[0]).To(BeAssignableToTypeOf(Inserted{}))
+		Expect(events[0].(Inserted).Index).To(Equal(1))
+		Expect(events[1].(Inserted).Data).To(Equal("!"))
+	})
+
+	It("stops reporting once cancelled", func() {
+		other := []Event{}
+		cancel := doc.Subscribe(func(e Event) {
+			other = append(other, e)
+		})
+		doc.Insert(pos[1], "beautiful")
+		cancel()
+		doc.Delete(pos[1])
+		Expect(other).To(HaveLen(1))
+		Expect(events).To(HaveLen(2))
+	})
+
+	It("lets views follow remote edits", func() {
+		var buf bytes.Buffer
+		_, err := doc.WriteTo(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		remote, err := ReadFrom(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		view := doc.Data()
+		doc.Subscribe(func(e Event) {
+			switch e := e.(type) {
+			case Inserted:
+				view = append(view[:e.Index], append([]string{e.Data}, view[e.Index:]...)...)
+			case Deleted:
+				Expect(view[e.Index]).To(Equal(e.Data))
+				view = append(view[:e.Index], view[e.Index+1:]...)
+			}
+		})
+
+		rnd := rand.New(rand.NewSource(1))
+		for k := 0; k < 100; k++ {
+			data := remote.Data()
+			next := []string{}
+			if len(data) > 0 && rnd.Intn(3) == 0 {
+				idx := rnd.Intn(len(data))
+				next = append(next, data[:idx]...)
+				next = append(next, data[idx+1:]...)
+			} else {
+				idx := rnd.Intn(len(data) + 1)
+				next = append(next, data[:idx]...)
+				next = append(next, fmt.Sprintf("edit %d", k))
+				next = append(next, data[idx:]...)
+			}
+			p, err := NewPatch(remote, site+1, next)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(remote)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(view).To(Equal(doc.Data()))
+		}
+	})
+})
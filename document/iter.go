@@ -0,0 +1,106 @@
+package document
+
+import (
+	"iter"
+
+	"github.com/mezis/lseq/position"
+)
+
+// Atom -
+// An atom of a document, as yielded by iterators; see `Snapshot.AtomsFrom`.
+type Atom struct {
+	Pos  *position.Position
+	Data string
+}
+
+// Call `cb` with the index and atom of those indexed `from` up to `to`
+// excluded, in order, while it returns true.
+func (s *Snapshot) each(from int, to int, cb func(int, *atom) bool) {
+	k := from
+	s.atoms.each(from+1, func(a *atom) bool {
+		if k >= to || !cb(k, a) {
+			return false
+		}
+		k++
+		return true
+	})
+}
+
+func (s *Snapshot) checkRange(from int, to int) {
+	if from < 0 || from > to || to > s.Length() {
+		panic("index out of bounds")
+	}
+}
+
+// EachRange iterates through the atoms indexed `from` up to `to` excluded,
+// passing them to the "cb" callback. Takes O(log n) time, plus the length of
+// the range; unlike calling `At` for each index.
+func (s *Snapshot) EachRange(from int, to int, cb func(number uint, pos *position.Position, data string)) {
+	s.checkRange(from, to)
+	s.each(from, to, func(k int, a *atom) bool {
+		cb(uint(k), a.pos, a.data)
+		return true
+	})
+}
+
+// Slice returns the data of the atoms indexed `from` up to `to` excluded,
+// eg. the lines shown in a viewport.
+func (s *Snapshot) Slice(from int, to int) []string {
+	s.checkRange(from, to)
+	out := make([]string, 0, to-from)
+	s.each(from, to, func(_ int, a *atom) bool {
+		out = append(out, a.data)
+		return true
+	})
+	return out
+}
+
+// AtomsFrom returns an iterator over the atoms from the one indexed `from`
+// to the last, with their indices.
+func (s *Snapshot) AtomsFrom(from int) iter.Seq2[int, Atom] {
+	s.checkRange(from, s.Length())
+	return s.atomsFrom(from)
+}
+
+// AtomsFromPosition returns an iterator over the atoms from the one at `pos`,
+// or the first after it, to the last, with their indices. Yields nothing if
+// `pos` is of another shape.
+func (s *Snapshot) AtomsFromPosition(pos *position.Position) iter.Seq2[int, Atom] {
+	if !pos.Shape().Compatible(s.shape) {
+		return s.atomsFrom(s.Length())
+	}
+	idx, _ := s.atoms.search(pos)
+	return s.atomsFrom(min(max(idx-1, 0), s.Length()))
+}
+
+func (s *Snapshot) atomsFrom(from int) iter.Seq2[int, Atom] {
+	return func(yield func(int, Atom) bool) {
+		s.each(from, s.Length(), func(k int, a *atom) bool {
+			return yield(k, Atom{a.pos, a.data})
+		})
+	}
+}
+
+// EachRange iterates through the atoms indexed `from` up to `to` excluded,
+// passing them to the "cb" callback; see `Snapshot.EachRange`.
+func (doc *Document) EachRange(from int, to int, cb func(number uint, pos *position.Position, data string)) {
+	doc.Snapshot().EachRange(from, to, cb)
+}
+
+// Slice returns the data of the atoms indexed `from` up to `to` excluded.
+func (doc *Document) Slice(from int, to int) []string {
+	return doc.Snapshot().Slice(from, to)
+}
+
+// AtomsFrom returns an iterator over the atoms from the one indexed `from`,
+// with their indices. It iterates through the document as it was when called,
+// so the document may change meanwhile.
+func (doc *Document) AtomsFrom(from int) iter.Seq2[int, Atom] {
+	return doc.Snapshot().AtomsFrom(from)
+}
+
+// AtomsFromPosition returns an iterator over the atoms from the one at `pos`,
+// or the first after it, with their indices; see `AtomsFrom`.
+func (doc *Document) AtomsFromPosition(pos *position.Position) iter.Seq2[int, Atom] {
+	return doc.Snapshot().AtomsFromPosition(pos)
+}
@@ -0,0 +1,153 @@
+package document_test
+
+import (
+	"fmt"
+	"iter"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Document ranges", func() {
+	site := uid.Uid(0xF00F00F0)
+	var doc *Document
+	var lines []string
+
+	BeforeEach(func() {
+		doc = NewDocument(WithAllocator(position.WithSeed(1)))
+		lines = []string{}
+		for k := 0; k < 100; k++ {
+			lines = append(lines, fmt.Sprintf("line %d", k))
+		}
+		p, err := NewPatch(doc, site, lines)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	collect := func(seq iter.Seq2[int, Atom]) ([]int, []string) {
+		indices, data := []int{}, []string{}
+		for k, a := range seq {
+			indices = append(indices, k)
+			data = append(data, a.Data)
+		}
+		return indices, data
+	}
+
+	Describe("EachRange", func() {
+		It("iterates through the range", func() {
+			n := uint(10)
+			doc.EachRange(10, 20, func(k uint, pos *position.Position, data string) {
+				Expect(k).To(Equal(n))
+				q, d := doc.At(int(k))
+				Expect(pos).To(Equal(q))
+				Expect(data).To(Equal(d))
+				n++
+			})
+			Expect(n).To(Equal(uint(20)))
+		})
+
+		It("does nothing for empty ranges", func() {
+			called := false
+			doc.EachRange(100, 100, func(uint, *position.Position, string) { called = true })
+			doc.EachRange(0, 0, func(uint, *position.Position, string) { called = true })
+			Expect(called).To(BeFalse())
+		})
+
+		It("panics out of bounds", func() {
+			cb := func(uint, *position.Position, string) {}
+			Expect(func() { doc.EachRange(-1, 10, cb) }).To(Panic())
+			Expect(func() { doc.EachRange(10, 101, cb) }).To(Panic())
+			Expect(func() { doc.EachRange(20, 10, cb) }).To(Panic())
+		})
+	})
+
+	Describe("Slice", func() {
+		It("returns data in the range", func() {
+			Expect(doc.Slice(50, 53)).To(Equal([]string{"line 50", "line 51", "line 52"}))
+			Expect(doc.Slice(0, 100)).To(Equal(lines))
+			Expect(doc.Slice(100, 100)).To(BeEmpty())
+		})
+
+		It("is empty for empty documents", func() {
+			Expect(NewDocument().Slice(0, 0)).To(BeEmpty())
+		})
+
+		It("panics out of bounds", func() {
+			Expect(func() { doc.Slice(99, 101) }).To(Panic())
+		})
+	})
+
+	Describe("AtomsFrom", func() {
+		It("yields atoms from an index", func() {
+			indices, data := collect(doc.AtomsFrom(97))
+			Expect(indices).To(Equal([]int{97, 98, 99}))
+			Expect(data).To(Equal([]string{"line 97", "line 98", "line 99"}))
+		})
+
+		It("yields nothing from the end", func() {
+			indices, _ := collect(doc.AtomsFrom(100))
+			Expect(indices).To(BeEmpty())
+		})
+
+		It("stops early", func() {
+			n := 0
+			for k := range doc.AtomsFrom(0) {
+				if k == 5 {
+					break
+				}
+				n++
+			}
+			Expect(n).To(Equal(5))
+		})
+
+		It("is unaffected by changes while iterating", func() {
+			data := []string{}
+			for k, a := range doc.AtomsFrom(98) {
+				doc.Delete(a.Pos)
+				Expect(doc.Length()).To(Equal(100 - len(data) - 1))
+				data = append(data, a.Data)
+				Expect(k).To(Equal(97 + len(data)))
+			}
+			Expect(data).To(Equal([]string{"line 98", "line 99"}))
+		})
+
+		It("panics out of bounds", func() {
+			Expect(func() { doc.AtomsFrom(101) }).To(Panic())
+		})
+	})
+
+	Describe("AtomsFromPosition", func() {
+		It("yields atoms from a position", func() {
+			pos, _ := doc.At(97)
+			indices, data := collect(doc.AtomsFromPosition(pos))
+			Expect(indices).To(Equal([]int{97, 98, 99}))
+			Expect(data).To(Equal([]string{"line 97", "line 98", "line 99"}))
+		})
+
+		It("yields atoms after a deleted position", func() {
+			pos, _ := doc.At(97)
+			doc.Delete(pos)
+			indices, data := collect(doc.AtomsFromPosition(pos))
+			Expect(indices).To(Equal([]int{97, 98}))
+			Expect(data).To(Equal([]string{"line 98", "line 99"}))
+		})
+
+		It("skips sentinels", func() {
+			_, data := collect(doc.AtomsFromPosition(doc.Shape().Head()))
+			Expect(data).To(Equal(lines))
+			indices, _ := collect(doc.AtomsFromPosition(doc.Shape().Tail()))
+			Expect(indices).To(BeEmpty())
+		})
+
+		It("yields nothing for positions of another shape", func() {
+			other := NewDocument(WithAllocator(position.WithShape(position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10})))
+			indices, _ := collect(doc.AtomsFromPosition(other.Shape().Head()))
+			Expect(indices).To(BeEmpty())
+		})
+	})
+})
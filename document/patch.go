@@ -1,7 +1,11 @@
 package document
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"strings"
 
 	"github.com/mezis/lseq/position"
@@ -9,87 +13,284 @@ import (
 	"github.com/pmezard/go-difflib/difflib"
 )
 
-type patchOp bool
+// Op is the operation of a patch `Item`.
+type Op bool
 
 const (
-	patchOpDelete patchOp = false
-	patchOpInsert patchOp = true
+	OpDelete Op = false
+	OpInsert Op = true
 )
 
-type patchItem struct {
-	op   patchOp
+// String --
+// Implement `fmt.Stringer`, as "+" for insertions and "-" for deletions.
+func (op Op) String() string {
+	if op == OpInsert {
+		return "+"
+	}
+	return "-"
+}
+
+// Item is a single operation of a `Patch`: the insertion or deletion of an
+// atom.
+type Item struct {
+	op   Op
 	pos  *position.Position
 	data string
 }
 
-// type patchId [16]byte
+// NewItem returns an item performing `op` on the atom at `pos`, whose content
+// is `data`.
+func NewItem(op Op, pos *position.Position, data string) Item {
+	return Item{op, pos, data}
+}
+
+// Op returns whether the item inserts or deletes an atom.
+func (i Item) Op() Op {
+	return i.op
+}
+
+// Pos returns the position of the atom inserted or deleted.
+func (i Item) Pos() *position.Position {
+	return i.pos
+}
+
+// Data returns the content of the atom inserted or deleted.
+func (i Item) Data() string {
+	return i.data
+}
+
+// String --
+// Implement `fmt.Stringer`.
+func (i Item) String() string {
+	return fmt.Sprintf("%v\n%v%v", i.pos, i.op, i.data)
+}
+
+// PatchID identifies a patch by its contents; see `Patch.ID`.
+type PatchID [16]byte
+
+// String --
+// Implement `fmt.Stringer`, in hexadecimal.
+func (id PatchID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Patch is a list of items (insertions and deletions) to apply to a document,
+// in order.
+type Patch struct {
+	site  uid.Uid // where the patch originates
+	nonce uint64  // random; see `ID`
+	items []Item
+}
+
+// NewPatchFromItems returns a patch of `items` originating from `site`; eg. to
+// relay parts of a patch built elsewhere. Its `ID` is a new one: relay whole
+// patches as they are, eg. encoded, for replicas to ignore redeliveries.
+func NewPatchFromItems(site uid.Uid, items ...Item) *Patch {
+	out := new(Patch)
+	out.site = site
+	out.nonce = rand.Uint64()
+	out.items = append(out.items, items...)
+	return out
+}
 
-type patch struct {
-	// id    patchId // hash of patch items
-	items []patchItem
+// Return an empty patch from `site`, whose nonce is drawn from the allocator
+// of `doc`; so that it is reproducible when the allocator is seeded.
+func (doc *Document) newPatch(site uid.Uid) *Patch {
+	return &Patch{site: site, nonce: doc.alloc.Uint64()}
 }
 
-func (p *patch) add(op patchOp, pos *position.Position, data string) {
-	p.items = append(p.items, patchItem{op, pos, data})
+// Site returns the identifier of the site the patch originates from.
+func (p *Patch) Site() uid.Uid {
+	return p.site
 }
 
-func (p *patch) Length() int {
+// ID returns a hash of the patch's site, nonce, and items (SHA-256,
+// truncated to 128 bits); patches with the same ID have the same effect.
+//
+// The nonce is a random number drawn when the patch is built, and kept when it
+// is encoded; so that documents ignore patches delivered more than once, but
+// not new patches with the same site and items, eg. typing a character again.
+//
+// The hash is of version 1 of an encoding of patches dedicated to IDs, which
+// is frozen: as documents keep the IDs of the patches they applied, eg. in
+// snapshots, IDs must not change with the encodings of patches or positions.
+func (p *Patch) ID() PatchID {
+	sum := sha256.Sum256(p.appendIDv1(nil))
+
+	var out PatchID
+	copy(out[:], sum[:])
+	return out
+}
+
+// Append version 1 of the encoding hashed by `ID` to `out`: "lseq patch"; the
+// site and the nonce, 8 bytes each, big-endian; the uvarint count of items; then each item's op,
+// a byte, 0 for deletions and 1 for insertions; position, its uvarint length,
+// then version 1 of its binary encoding; and data, its uvarint length, then
+// bytes. Frozen, see `ID`.
+func (p *Patch) appendIDv1(out []byte) []byte {
+	out = append(out, "lseq patch"...)
+	out = binary.BigEndian.AppendUint64(out, uint64(p.site))
+	out = binary.BigEndian.AppendUint64(out, p.nonce)
+	out = binary.AppendUvarint(out, uint64(len(p.items)))
+	for _, i := range p.items {
+		op := byte(0)
+		if i.op == OpInsert {
+			op = 1
+		}
+		out = append(out, op)
+
+		pos, _ := i.pos.MarshalBinaryVersion(1)
+		out = binary.AppendUvarint(out, uint64(len(pos)))
+		out = append(out, pos...)
+
+		out = binary.AppendUvarint(out, uint64(len(i.data)))
+		out = append(out, i.data...)
+	}
+	return out
+}
+
+// Add appends an item performing `op` on the atom at `pos`, whose content is
+// `data`.
+func (p *Patch) Add(op Op, pos *position.Position, data string) {
+	p.items = append(p.items, Item{op, pos, data})
+}
+
+// Items returns the items of the patch, in order.
+func (p *Patch) Items() []Item {
+	return append([]Item(nil), p.items...)
+}
+
+// Length returns the number of items of the patch.
+func (p *Patch) Length() int {
 	return len(p.items)
 }
 
-func (p *patch) String() string {
+// Invert returns a patch from the same site, undoing `p`: it has the items of
+// `p` in reverse order, deleting the atoms `p` inserts and inserting those it
+// deletes. It has a new `ID`.
+//
+// As documents never insert atoms at deleted positions again, the insertions
+// of the inverse are ignored; `UndoManager` re-inserts them at fresh
+// positions.
+func (p *Patch) Invert() *Patch {
+	out := &Patch{site: p.site, nonce: rand.Uint64(), items: make([]Item, len(p.items))}
+	for k, i := range p.items {
+		i.op = !i.op
+		out.items[len(p.items)-1-k] = i
+	}
+	return out
+}
+
+func (p *Patch) String() string {
 	buf := make([]string, len(p.items))
 	for k, i := range p.items {
-		buf[k] = fmt.Sprintf("%v\n%v%v", i.pos, i.op, i.data)
+		buf[k] = i.String()
 	}
 	return strings.Join(buf, "\n")
 }
 
-// NewPatch returns a new `patch` that, when applied, transforms the text of `doc` into the
+// NewPatch returns a new `Patch` that, when applied, transforms the text of `doc` into the
 // argument list of atoms.
-func NewPatch(doc *Document, site uid.Uid, data []string) *patch {
-	out := new(patch)
+//
+// When no positions are left between two atoms for new ones, unchanged atoms
+// following them are relocated: deleted and inserted again elsewhere, which
+// other replicas cannot tell from an edit. Concurrent edits of relocated atoms
+// are then lost: eg. a replica deleting one of them concurrently sees it come
+// back. See `addInsertions`.
+//
+// Returns `position.ErrExhausted` if positions cannot be allocated for new
+// atoms, even after relocating neighbouring ones.
+func NewPatch(doc *Document, site uid.Uid, data []string) (*Patch, error) {
+	out := doc.newPatch(site)
 
 	matcher := difflib.NewMatcher(doc.Data(), data)
+	ops := matcher.GetOpCodes()
+
+	// the new position of the last atom relocated so far, and the index of the
+	// atom following it
+	var relocated *position.Position
+	next := -1
 
-	for _, op := range matcher.GetOpCodes() {
+	for k, op := range ops {
 		switch op.Tag {
-		case 'r':
+		case 'r', 'd':
 			for i := op.I1; i < op.I2; i++ {
 				p, s := doc.At(i)
-				out.add(patchOpDelete, p, s)
+				out.Add(OpDelete, p, s)
 			}
-			pos := doc.Allocate(op.I2, op.J2-op.J1, site)
-			for j := op.J1; j < op.J2; j++ {
-				out.add(patchOpInsert, pos[j-op.J1], data[j])
+		default: // 'e' (equal) tag, nothing to do
+		}
+
+		switch op.Tag {
+		case 'r', 'i':
+			// unchanged atoms following the insertion can be relocated
+			movable := 0
+			if k+1 < len(ops) && ops[k+1].Tag == 'e' {
+				movable = ops[k+1].I2 - ops[k+1].I1
 			}
-		case 'd':
-			for i := op.I1; i < op.I2; i++ {
-				p, s := doc.At(i)
-				out.add(patchOpDelete, p, s)
+			// insert after atoms relocated before the same atom, if any
+			var after *position.Position
+			if op.I2 == next {
+				after = relocated
 			}
-		case 'i':
-			pos := doc.Allocate(op.I2, op.J2-op.J1, site)
-			for j := op.J1; j < op.J2; j++ {
-				out.add(patchOpInsert, pos[j-op.J1], data[j])
+			var err error
+			relocated, next, err = out.addInsertions(doc, op.I2, after, movable, data[op.J1:op.J2], site)
+			if err != nil {
+				return nil, err
 			}
-		default: // 'e' (equal) tag, nothing to do
 		}
 	}
-	return out
+	return out, nil
 }
 
-// Apply
-// iterates through patch items and applies them all to the argument Document.
-func (p *patch) Apply(doc *Document) {
-	for _, i := range p.items {
-		switch i.op {
-		case patchOpInsert:
-			doc.Insert(i.pos, i.data)
-		case patchOpDelete:
-			doc.Delete(i.pos)
-		default:
-			panic(fmt.Sprintf("unknown patch operation %#v", i.op))
+// Add insertions of `data` before the atom at index `idx` of `doc`, and after
+// `after` if not nil.
+//
+// When there is no room left there, recover by relocating the `movable` atoms
+// following `idx`, ie. deleting them and inserting them again after `data`, so
+// that positions can be allocated in the wider gap after them; which are
+// after the relocated atoms' positions, so they don't overlap.
+//
+// Relocated atoms are new atoms to other replicas, and the old ones are gone:
+// a concurrent deletion of one of them is undone, concurrent insertions next
+// to one may end up on its other side, and cursors anchored to them stay at
+// their old positions, before `data`. Hence relocating as few atoms as will
+// do.
+//
+// Returns the new position of the last atom relocated, and the index of the
+// atom following it; or nil and -1 if none was.
+func (p *Patch) addInsertions(doc *Document, idx int, after *position.Position, movable int, data []string, site uid.Uid) (*position.Position, int, error) {
+	left := doc.atoms.at(idx)
+	if after != nil {
+		left = &atom{pos: after}
+	}
+	pos, err := doc.allocate(left, doc.atoms.at(idx+1), len(data), site)
+
+	moved := 0
+	for err == position.ErrExhausted && moved < movable {
+		moved = 2*moved + 1
+		if moved > movable {
+			moved = movable
 		}
+		pos, err = doc.allocateBetween(idx+moved-1, idx+moved, len(data)+moved, site)
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for k := 0; k < moved; k++ {
+		q, s := doc.At(idx + k)
+		p.Add(OpDelete, q, s)
+	}
+	for k, s := range data {
+		p.Add(OpInsert, pos[k], s)
+	}
+	for k := 0; k < moved; k++ {
+		_, s := doc.At(idx + k)
+		p.Add(OpInsert, pos[len(data)+k], s)
+	}
+	if moved == 0 {
+		return nil, -1, nil
 	}
+	return pos[len(pos)-1], idx + moved, nil
 }
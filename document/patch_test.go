@@ -1,7 +1,12 @@
 package document_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
 	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
 	"github.com/mezis/lseq/uid"
 
 	. "github.com/onsi/ginkgo"
@@ -15,7 +20,7 @@ var _ = Describe("patch", func() {
 			It("build an empty patch for empty documents", func() {
 				left := NewDocument()
 				right := []string{}
-				p := NewPatch(left, site, right)
+				p, _ := NewPatch(left, site, right)
 
 				Expect(p.Length()).To(Equal(0))
 			})
@@ -23,7 +28,7 @@ var _ = Describe("patch", func() {
 			It("build a patch of length 2 when adding 2 atoms", func() {
 				left := NewDocument()
 				right := []string{"hello", "world"}
-				p := NewPatch(left, site, right)
+				p, _ := NewPatch(left, site, right)
 
 				Expect(p.Length()).To(Equal(2))
 			})
@@ -33,7 +38,7 @@ var _ = Describe("patch", func() {
 		data := []string{"hello", "beautiful", "world"}
 		buildDocument := func() *Document {
 			out := NewDocument()
-			p := NewPatch(out, site, data)
+			p, _ := NewPatch(out, site, data)
 			p.Apply(out)
 			return out
 		}
@@ -44,10 +49,22 @@ var _ = Describe("patch", func() {
 		})
 
 		Describe("patch.Apply", func() {
+			It("refuses patches from documents of other shapes", func() {
+				doc := buildDocument()
+				other := NewDocument(WithAllocator(position.WithShape(position.TreeShape{RootBits: 8, Growth: 1, MaxDigits: 20})))
+				p, _ := NewPatch(other, site, []string{"foo"})
+				_, err := p.Apply(doc)
+				Expect(err).To(MatchError(position.ErrShapeMismatch))
+				Expect(doc.Data()).To(Equal(data))
+			})
+
 			check := func(target []string) {
 				doc := buildDocument()
-				p := NewPatch(doc, site, target)
-				p.Apply(doc)
+				p, _ := NewPatch(doc, site, target)
+				res, err := p.Apply(doc)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.OK()).To(BeTrue())
+				Expect(res.Applied).To(Equal(p.Items()))
 
 				Expect(doc.Data()).To(Equal(target))
 			}
@@ -64,7 +81,331 @@ var _ = Describe("patch", func() {
 				check([]string{"hello", "frabjous", "world"})
 			})
 
+			It("keeps inserting at the same spot", func() {
+				doc := buildDocument()
+				target := doc.Data()
+				idx := 1
+				for k := 0; k < 500; k++ {
+					next := append([]string{}, target[:idx]...)
+					next = append(next, fmt.Sprintf("edit%03d", k))
+					next = append(next, target[idx:]...)
+
+					p, err := NewPatch(doc, site, next)
+					Expect(err).NotTo(HaveOccurred())
+					p.Apply(doc)
+					Expect(doc.Data()).To(Equal(next))
+
+					// alternate between inserting before and after the last edit
+					target = next
+					idx += k % 2
+				}
+			})
+
+			It("inserts after atoms relocated by an earlier insertion", func() {
+				shape := position.TreeShape{RootBits: 3, Growth: 0, MaxDigits: 2, Boundary: 2}
+				next := []string{}
+				for k := 0; k < 10; k++ {
+					next = append(next, fmt.Sprintf("X%d", k))
+				}
+				next = append(next, "a", "Y", "b", "c")
+
+				for seed := int64(0); seed < 200; seed++ {
+					doc := NewDocument(WithAllocator(position.WithShape(shape), position.WithSeed(seed)))
+					p, err := NewPatch(doc, site+1, []string{"a", "b", "c"})
+					Expect(err).NotTo(HaveOccurred())
+					p.Apply(doc)
+
+					p, err = NewPatch(doc, site+1, next)
+					Expect(err).NotTo(HaveOccurred())
+					p.Apply(doc)
+					Expect(doc.Data()).To(Equal(next), "seed %d", seed)
+				}
+			})
+
+			It("undoes concurrent deletions of relocated atoms", func() {
+				shape := position.TreeShape{RootBits: 3, Growth: 0, MaxDigits: 2, Boundary: 2}
+				next := []string{}
+				for k := 0; k < 10; k++ {
+					next = append(next, fmt.Sprintf("X%d", k))
+				}
+				next = append(next, "a", "b", "c")
+
+				for seed := int64(0); seed < 200; seed++ {
+					local := NewDocument(WithAllocator(position.WithShape(shape), position.WithSeed(seed)))
+					remote := NewDocument(WithAllocator(position.WithShape(shape)))
+					p, err := NewPatch(local, site+1, []string{"a", "b", "c"})
+					Expect(err).NotTo(HaveOccurred())
+					p.Apply(local)
+					p.Apply(remote)
+
+					// concurrently, insert before "a" locally, relocating it, and
+					// delete it remotely
+					pos, data := local.At(0)
+					p, err = NewPatch(local, site+1, next)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(p.Items()).To(ContainElement(NewItem(OpDelete, pos, data)), "seed %d", seed)
+					q, err := NewPatch(remote, site+2, []string{"b", "c"})
+					Expect(err).NotTo(HaveOccurred())
+
+					p.Apply(local)
+					q.Apply(local)
+					q.Apply(remote)
+					p.Apply(remote)
+					Expect(local.Data()).To(Equal(next), "seed %d", seed)
+					Expect(remote.Data()).To(Equal(next), "seed %d", seed)
+				}
+			})
 		})
 	})
 
+	Describe("Patch", func() {
+		It("exposes its items", func() {
+			doc := NewDocument()
+			p, _ := NewPatch(doc, site, []string{"hello", "world"})
+			items := p.Items()
+			Expect(items).To(HaveLen(2))
+			Expect(items[0].Op()).To(Equal(OpInsert))
+			Expect(items[0].Data()).To(Equal("hello"))
+			Expect(items[1].Data()).To(Equal("world"))
+			Expect(items[0].Pos().IsBefore(items[1].Pos())).To(BeTrue())
+
+			p.Apply(doc)
+			q, _ := NewPatch(doc, site, []string{"world"})
+			Expect(q.Items()).To(Equal([]Item{NewItem(OpDelete, items[0].Pos(), "hello")}))
+		})
+
+		It("can be built by hand", func() {
+			doc := NewDocument()
+			pos, _ := doc.Allocate(0, 2, site)
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[1], "world"))
+			p.Add(OpInsert, pos[0], "hello")
+			Expect(p.Length()).To(Equal(2))
+			_, err := p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(doc.Data()).To(Equal([]string{"hello", "world"}))
+		})
+
+		It("can be relayed in parts", func() {
+			origin, replica := NewDocument(), NewDocument()
+			p, _ := NewPatch(origin, site, []string{"hello", "beautiful", "world"})
+			for _, i := range p.Items() {
+				_, err := NewPatchFromItems(site, i).Apply(replica)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(replica.Data()).To(Equal([]string{"hello", "beautiful", "world"}))
+		})
+
+		It("keeps its ID when encoded", func() {
+			doc := NewDocument()
+			pos, _ := doc.Allocate(0, 1, site)
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[0], "hello"))
+			buf, err := p.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			q := new(Patch)
+			Expect(q.UnmarshalBinary(buf)).To(Succeed())
+			Expect(q.ID()).To(Equal(p.ID()))
+			Expect(p.ID().String()).To(HaveLen(32))
+		})
+
+		It("has a new ID when built again", func() {
+			doc := NewDocument()
+			pos, _ := doc.Allocate(0, 1, site)
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[0], "hello"))
+			Expect(NewPatchFromItems(site, p.Items()...).ID()).NotTo(Equal(p.ID()))
+
+			doc = NewDocument(WithAllocator(position.WithStrategy(position.Sequential{})))
+			q, _ := NewPatch(doc, site, []string{"hello"})
+			r, _ := NewPatch(doc, site, []string{"hello"})
+			Expect(r.Items()).To(Equal(q.Items()))
+			Expect(r.ID()).NotTo(Equal(q.ID()))
+		})
+
+		It("has stable IDs", func() {
+			p := new(Patch)
+			Expect(json.Unmarshal([]byte(`{
+				"version": 1, "site": "F00F00F0", "nonce": "123456789ABCDEF0",
+				"items": [
+					{"op": "insert", "pos": "<7 @F00F00F0, 3 @BA5EBA11>", "data": "hello"},
+					{"op": "delete", "pos": "<7 @F00F00F0, 3 @BA5EBA11>", "data": "hello"}
+				],
+				"checksum": 4125735771
+			}`), p)).To(Succeed())
+			Expect(p.ID().String()).To(Equal("d574c2b88d42bef5e108f5ff538f9ac1"))
+		})
+
+		It("applies identical edits made again", func() {
+			doc, replica := NewDocument(), NewDocument()
+			pos, _ := doc.Allocate(0, 1, site)
+			for k := 0; k < 2; k++ {
+				p := NewPatchFromItems(site, NewItem(OpInsert, pos[0], "hello"), NewItem(OpDelete, pos[0], "hello"))
+				res, err := p.Apply(replica)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.Redelivered).To(BeFalse())
+			}
+		})
+
+		It("applies atoms typed again after their deletion", func() {
+			doc := NewDocument(WithAllocator(position.WithStrategy(position.Sequential{})))
+			for _, data := range [][]string{{"hello"}, {}, {"hello"}} {
+				p, err := NewPatch(doc, site, data)
+				Expect(err).NotTo(HaveOccurred())
+				res, err := p.Apply(doc)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.Redelivered).To(BeFalse())
+				Expect(res.OK()).To(BeTrue())
+				Expect(doc.Data()).To(Equal(data))
+			}
+		})
+
+		It("is applied at most once", func() {
+			doc := NewDocument()
+			p, _ := NewPatch(doc, site, []string{"hello", "world"})
+			Expect(doc.Applied(p.ID())).To(BeFalse())
+			_, err := p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(doc.Applied(p.ID())).To(BeTrue())
+
+			q, _ := NewPatch(doc, site, []string{"world"})
+			_, err = q.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(doc.Data()).To(Equal([]string{"world"}))
+		})
+
+		It("prints its items", func() {
+			pos, _ := NewDocument().Allocate(0, 1, site)
+			p := NewPatchFromItems(site, NewItem(OpInsert, pos[0], "hello"), NewItem(OpDelete, pos[0], "hello"))
+			Expect(p.String()).To(Equal(fmt.Sprintf("%v\n+hello\n%v\n-hello", pos[0], pos[0])))
+		})
+	})
+
+	Context("Given replicas receiving patches in any order", func() {
+		// Make `n` random edits to `doc` from `site`, returning their patches.
+		edit := func(rnd *rand.Rand, doc *Document, site uid.Uid, n int) []*Patch {
+			out := []*Patch{}
+			for k := 0; k < n; k++ {
+				data := doc.Data()
+				idx := rnd.Intn(len(data) + 1)
+				next := append([]string{}, data[:idx]...)
+				switch {
+				case len(data) == 0 || rnd.Intn(3) > 0: // insert
+					next = append(next, fmt.Sprintf("%v-%d", site, k))
+					next = append(next, data[idx:]...)
+				case idx < len(data): // delete
+					next = append(next, data[idx+1:]...)
+				default: // replace
+					next = append(next[:idx-1], fmt.Sprintf("%v-%d", site, k))
+				}
+
+				p, err := NewPatch(doc, site, next)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = p.Apply(doc)
+				Expect(err).NotTo(HaveOccurred())
+				out = append(out, p)
+			}
+			return out
+		}
+
+		It("converges to the state of a single editing site", func() {
+			for seed := int64(0); seed < 20; seed++ {
+				rnd := rand.New(rand.NewSource(seed))
+				origin := NewDocument()
+				patches := edit(rnd, origin, 0xA, 30)
+
+				for r := 0; r < 5; r++ {
+					replica := NewDocument()
+					for _, k := range rnd.Perm(len(patches)) {
+						patches[k].Apply(replica)
+					}
+					Expect(replica.Data()).To(Equal(origin.Data()), "seed %d", seed)
+				}
+			}
+		})
+
+		It("converges with concurrent editing sites", func() {
+			for seed := int64(0); seed < 20; seed++ {
+				rnd := rand.New(rand.NewSource(seed))
+				patches := []*Patch{}
+				for _, site := range []uid.Uid{0xA, 0xB, 0xC} {
+					patches = append(patches, edit(rnd, NewDocument(), site, 20)...)
+				}
+
+				var want []string
+				for r := 0; r < 5; r++ {
+					replica := NewDocument()
+					for _, k := range rnd.Perm(len(patches)) {
+						patches[k].Apply(replica)
+					}
+					if r == 0 {
+						want = replica.Data()
+					}
+					Expect(replica.Data()).To(Equal(want), "seed %d", seed)
+				}
+			}
+		})
+
+		It("converges with sites editing each other's atoms", func() {
+			sites := []uid.Uid{0xA, 0xB, 0xC}
+			for seed := int64(0); seed < 20; seed++ {
+				rnd := rand.New(rand.NewSource(seed))
+				docs := make([]*Document, len(sites))
+				for k := range docs {
+					docs[k] = NewDocument(WithAllocator(position.WithSeed(seed*int64(len(sites)) + int64(k))))
+				}
+				// patches each site has yet to receive
+				pending := make([][]*Patch, len(sites))
+				receive := func(k int, n int) {
+					rnd.Shuffle(len(pending[k]), func(i, j int) {
+						pending[k][i], pending[k][j] = pending[k][j], pending[k][i]
+					})
+					for _, p := range pending[k][:n] {
+						p.Apply(docs[k])
+					}
+					pending[k] = pending[k][n:]
+				}
+
+				patches := []*Patch{}
+				for step := 0; step < 60; step++ {
+					// a site receives some patches, in any order, then inserts
+					// or deletes an atom, whoever inserted it
+					k := rnd.Intn(len(sites))
+					receive(k, rnd.Intn(len(pending[k])+1))
+					data := docs[k].Data()
+					idx := rnd.Intn(len(data) + 1)
+					next := append([]string{}, data[:idx]...)
+					if idx == len(data) || rnd.Intn(2) == 0 {
+						next = append(next, fmt.Sprintf("%v-%d", sites[k], step))
+						next = append(next, data[idx:]...)
+					} else {
+						next = append(next, data[idx+1:]...)
+					}
+
+					p, err := NewPatch(docs[k], sites[k], next)
+					Expect(err).NotTo(HaveOccurred())
+					res, err := p.Apply(docs[k])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(res.OK()).To(BeTrue(), "seed %d", seed)
+					patches = append(patches, p)
+					for j := range sites {
+						if j != k {
+							pending[j] = append(pending[j], p)
+						}
+					}
+				}
+
+				for k := range sites {
+					receive(k, len(pending[k]))
+					Expect(docs[k].Data()).To(Equal(docs[0].Data()), "seed %d", seed)
+				}
+				for r := 0; r < 5; r++ {
+					replica := NewDocument()
+					for _, k := range rnd.Perm(len(patches)) {
+						patches[k].Apply(replica)
+					}
+					Expect(replica.Data()).To(Equal(docs[0].Data()), "seed %d", seed)
+				}
+			}
+		})
+	})
 })
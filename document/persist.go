@@ -0,0 +1,419 @@
+package document
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+)
+
+// Version of the snapshot format written by `WriteTo`.
+//
+// Layout:
+//
+//	version     byte
+//	uid         8 bytes, big-endian
+//	shape       3 bytes, root bits, growth, and maximum digits; then uvarint
+//	            boundary
+//	strategy    byte, the kind of the allocator's strategy, then its fields:
+//	              1  `position.LSEQ`: uvarint boundary, then uvarint length
+//	                 and `position.StrategyMap.MarshalBinary`
+//	              2  `position.HashLSEQ`: 8-byte big-endian seed, then uvarint
+//	                 boundary
+//	              3  `position.Logoot`
+//	              4  `position.BoundaryPlus`: uvarint boundary
+//	              5  `position.BoundaryMinus`: uvarint boundary
+//	              6  `position.Sequential`
+//	atoms       uvarint count, then once per atom, in order:
+//	              position  uvarint length, then `position.Position.MarshalBinary`
+//	              data      uvarint length, then bytes
+//	tombstones  uvarint count, then once per tombstone, in order, a position
+//	applied     uvarint count, then the 16-byte IDs of applied patches, sorted
+//	checksum    4 bytes, big-endian CRC-32 (IEEE) of all preceding bytes
+const snapshotVersion = 1
+
+// ErrUnknownStrategy is returned by `Document.WriteTo` for documents whose
+// allocator uses strategies other than those of the `position` package, which
+// snapshots cannot restore.
+var ErrUnknownStrategy = errors.New("document: cannot snapshot custom allocation strategies")
+
+// Kinds of strategies in snapshots; see `snapshotVersion`.
+const (
+	strategyLSEQ byte = iota + 1
+	strategyHashLSEQ
+	strategyLogoot
+	strategyBoundaryPlus
+	strategyBoundaryMinus
+	strategySequential
+)
+
+// WriteTo --
+// Implement `io.WriterTo`, writing a snapshot of the document: its `Uid`,
+// shape, allocation strategy, atoms, tombstones, and applied patches.
+// `ReadFrom` restores it, eg. for a new peer to bootstrap from and continue
+// applying patches.
+//
+// Returns `ErrUnknownStrategy`, writing nothing, if the document's allocator
+// uses a strategy from another package.
+func (doc *Document) WriteTo(w io.Writer) (int64, error) {
+	if strategyKind(doc.alloc.Strategy()) == 0 {
+		return 0, ErrUnknownStrategy
+	}
+	counter := &countingWriter{w: w}
+	out := &snapshotWriter{w: bufio.NewWriter(counter), crc: crc32.NewIEEE()}
+
+	shape := doc.alloc.Shape()
+
+	out.write([]byte{snapshotVersion})
+	out.write(binary.BigEndian.AppendUint64(nil, uint64(doc.Uid)))
+	out.write([]byte{shape.RootBits, shape.Growth, shape.MaxDigits})
+	out.uvarint(uint64(shape.Boundary))
+	out.strategy(doc.alloc.Strategy())
+
+	out.uvarint(uint64(doc.Length()))
+	doc.Each(func(_ uint, pos *position.Position, data string) {
+		out.position(pos)
+		out.bytes([]byte(data))
+	})
+
+	out.uvarint(doc.tombs.Len() - 1)
+	for k := uint64(1); k < doc.tombs.Len(); k++ {
+		out.position(doc.tombs.ByPosition(k).(*atom).pos)
+	}
+
+	applied := make([]PatchID, 0, len(doc.applied))
+	for id := range doc.applied {
+		applied = append(applied, id)
+	}
+	slices.SortFunc(applied, func(a, b PatchID) int { return bytes.Compare(a[:], b[:]) })
+	out.uvarint(uint64(len(applied)))
+	for _, id := range applied {
+		out.write(id[:])
+	}
+
+	out.write(binary.BigEndian.AppendUint32(nil, out.crc.Sum32()))
+	if out.err == nil {
+		out.err = out.w.Flush()
+	}
+	return counter.n, out.err
+}
+
+// ReadFrom returns the document whose snapshot, written by `WriteTo`, is read
+// from `r`. Its allocator has the snapshot's shape and, by default, its
+// strategy; `opts` can override them, eg. to seed it.
+//
+// Reads `r` directly if it is an `io.ByteReader`, eg. a `bufio.Reader`, and
+// then stops at the end of the snapshot; so that the same stream can carry
+// more, eg. patches. Otherwise, as reads are buffered, may read past it.
+func ReadFrom(r io.Reader, opts ...position.Option) (*Document, error) {
+	br, ok := r.(byteReadingReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	in := &snapshotReader{r: br, crc: crc32.NewIEEE()}
+
+	version := in.byte()
+	if in.err == nil && version != snapshotVersion {
+		return nil, VersionError(version)
+	}
+	id := uid.Uid(binary.BigEndian.Uint64(in.read(8)))
+	header := in.read(3)
+	if in.err != nil {
+		return nil, in.err
+	}
+	shape := position.TreeShape{RootBits: header[0], Growth: header[1], MaxDigits: header[2]}
+	shape.Boundary = int(in.uvarint())
+	if err := shape.Validate(); err != nil {
+		return nil, err
+	}
+	strategy := in.strategy()
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	opts = append([]position.Option{position.WithShape(shape), position.WithStrategy(strategy)}, opts...)
+	doc := NewDocument(WithAllocator(opts...))
+	doc.Uid = id
+
+	// atoms and tombstones are written in order, and don't repeat
+	load := func(insert func(*atom), withData bool) {
+		count := in.uvarint()
+		prev := shape.Head()
+		for k := uint64(0); k < count && in.err == nil; k++ {
+			a := newAtom(in.position(), "")
+			if withData {
+				a.data = string(in.bytes())
+			}
+			if in.err != nil {
+				return
+			}
+			if !doc.fits(a.pos) || a.pos.Validate() != nil || !prev.IsBefore(a.pos) {
+				in.err = ErrMalformed
+				return
+			}
+			insert(a)
+			prev = a.pos
+		}
+	}
+	load(func(a *atom) { doc.atoms = doc.atoms.insert(a) }, true)
+	load(func(a *atom) { doc.tombs.Insert(a) }, false)
+	count := in.uvarint()
+	for k := uint64(0); k < count && in.err == nil; k++ {
+		doc.applied[PatchID(in.read(len(PatchID{})))] = struct{}{}
+	}
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	sum := in.crc.Sum32()
+	stored := in.read(4)
+	if in.err != nil {
+		return nil, in.err
+	}
+	if binary.BigEndian.Uint32(stored) != sum {
+		return nil, ErrChecksum
+	}
+	return doc, nil
+}
+
+// Writes snapshots, keeping track of the first error and the checksum of the
+// bytes written.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func (out *snapshotWriter) write(buf []byte) {
+	if out.err != nil {
+		return
+	}
+	n, err := out.w.Write(buf)
+	out.crc.Write(buf[:n])
+	out.err = err
+}
+
+// Return the kind of `s` in snapshots, or 0 if it has none.
+func strategyKind(s position.Strategy) byte {
+	switch s.(type) {
+	case *position.LSEQ:
+		return strategyLSEQ
+	case position.HashLSEQ, *position.HashLSEQ:
+		return strategyHashLSEQ
+	case position.Logoot, *position.Logoot:
+		return strategyLogoot
+	case position.BoundaryPlus, *position.BoundaryPlus:
+		return strategyBoundaryPlus
+	case position.BoundaryMinus, *position.BoundaryMinus:
+		return strategyBoundaryMinus
+	case position.Sequential, *position.Sequential:
+		return strategySequential
+	}
+	return 0
+}
+
+// Write the kind of `s`, then its fields.
+func (out *snapshotWriter) strategy(s position.Strategy) {
+	// strategies with fields may be used by value or by pointer
+	switch p := s.(type) {
+	case *position.HashLSEQ:
+		s = *p
+	case *position.BoundaryPlus:
+		s = *p
+	case *position.BoundaryMinus:
+		s = *p
+	}
+
+	out.write([]byte{strategyKind(s)})
+	switch s := s.(type) {
+	case *position.LSEQ:
+		out.uvarint(uint64(max(s.Boundary, 0)))
+		buf, _ := s.Map.MarshalBinary()
+		out.bytes(buf)
+	case position.HashLSEQ:
+		out.write(binary.BigEndian.AppendUint64(nil, s.Seed))
+		out.uvarint(uint64(max(s.Boundary, 0)))
+	case position.BoundaryPlus:
+		out.uvarint(uint64(max(s.Boundary, 0)))
+	case position.BoundaryMinus:
+		out.uvarint(uint64(max(s.Boundary, 0)))
+	}
+}
+
+// Counts bytes written to `w`.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(buf []byte) (int, error) {
+	n, err := c.w.Write(buf)
+	c.n += int64(n)
+	return n, err
+}
+
+func (out *snapshotWriter) uvarint(val uint64) {
+	out.write(binary.AppendUvarint(nil, val))
+}
+
+func (out *snapshotWriter) bytes(buf []byte) {
+	out.uvarint(uint64(len(buf)))
+	out.write(buf)
+}
+
+func (out *snapshotWriter) position(pos *position.Position) {
+	buf, err := pos.MarshalBinary()
+	if err != nil && out.err == nil {
+		out.err = err
+	}
+	out.bytes(buf)
+}
+
+// What snapshots are read from.
+type byteReadingReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Reads snapshots, keeping track of the first error and the checksum of the
+// bytes read. Methods return zero values after an error.
+type snapshotReader struct {
+	r   byteReadingReader
+	crc hash.Hash32
+	err error
+}
+
+func (in *snapshotReader) fail(err error) {
+	if in.err != nil {
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	in.err = err
+}
+
+func (in *snapshotReader) byte() byte {
+	if in.err != nil {
+		return 0
+	}
+	b, err := in.r.ReadByte()
+	if err != nil {
+		in.fail(err)
+		return 0
+	}
+	in.crc.Write([]byte{b})
+	return b
+}
+
+// Read `n` bytes; only for small, fixed, `n`.
+func (in *snapshotReader) read(n int) []byte {
+	buf := make([]byte, n)
+	if in.err != nil {
+		return buf
+	}
+	if _, err := io.ReadFull(in.r, buf); err != nil {
+		in.fail(err)
+		return buf
+	}
+	in.crc.Write(buf)
+	return buf
+}
+
+func (in *snapshotReader) uvarint() uint64 {
+	if in.err != nil {
+		return 0
+	}
+	val, err := binary.ReadUvarint(byteReader{in})
+	if err != nil {
+		// unless reading failed, the uvarint overflows
+		in.fail(ErrMalformed)
+		return 0
+	}
+	return val
+}
+
+// Read a uvarint length, then as many bytes. The buffer grows as bytes are
+// read, so that bad lengths cannot exhaust memory.
+func (in *snapshotReader) bytes() []byte {
+	length := in.uvarint()
+	if in.err == nil && int64(length) < 0 {
+		in.fail(ErrMalformed)
+	}
+	if in.err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, in.r, int64(length)); err != nil {
+		in.fail(err)
+		return nil
+	}
+	in.crc.Write(buf.Bytes())
+	return buf.Bytes()
+}
+
+func (in *snapshotReader) position() *position.Position {
+	buf := in.bytes()
+	out := new(position.Position)
+	if in.err != nil {
+		return out
+	}
+	if err := out.UnmarshalBinary(buf); err != nil {
+		in.fail(err)
+	}
+	return out
+}
+
+// Read the kind of a strategy, then its fields.
+func (in *snapshotReader) strategy() position.Strategy {
+	switch kind := in.byte(); kind {
+	case strategyLSEQ:
+		s := &position.LSEQ{Boundary: in.boundary()}
+		if err := s.Map.UnmarshalBinary(in.bytes()); err != nil {
+			in.fail(err)
+		}
+		return s
+	case strategyHashLSEQ:
+		seed := binary.BigEndian.Uint64(in.read(8))
+		return position.HashLSEQ{Seed: seed, Boundary: in.boundary()}
+	case strategyLogoot:
+		return position.Logoot{}
+	case strategyBoundaryPlus:
+		return position.BoundaryPlus{Boundary: in.boundary()}
+	case strategyBoundaryMinus:
+		return position.BoundaryMinus{Boundary: in.boundary()}
+	case strategySequential:
+		return position.Sequential{}
+	}
+	in.fail(ErrMalformed)
+	return nil
+}
+
+// Read the boundary of a strategy.
+func (in *snapshotReader) boundary() int {
+	val := in.uvarint()
+	if val > math.MaxInt32 {
+		in.fail(ErrMalformed)
+		return 0
+	}
+	return int(val)
+}
+
+// Adapts `snapshotReader` to `io.ByteReader`.
+type byteReader struct{ in *snapshotReader }
+
+func (b byteReader) ReadByte() (byte, error) {
+	val := b.in.byte()
+	if b.in.err != nil {
+		return 0, b.in.err
+	}
+	return val, nil
+}
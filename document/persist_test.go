@@ -0,0 +1,257 @@
+package document_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Fails after accepting `n` bytes.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("disk full")
+	}
+	w.n -= len(buf)
+	return len(buf), nil
+}
+
+// Allocates in the middle of the free interval.
+type middle struct{}
+
+func (middle) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return (interval + 1) / 2
+}
+
+var _ = Describe("Document snapshots", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	buildDocument := func(opts ...Option) *Document {
+		doc := NewDocument(opts...)
+		for k := 0; k < 50; k++ {
+			data := doc.Data()
+			idx := (k * 7) % (len(data) + 1)
+			next := append([]string{}, data[:idx]...)
+			next = append(next, fmt.Sprintf("line %d", k))
+			if k%3 == 0 && idx < len(data) {
+				next = append(next, data[idx+1:]...)
+			} else {
+				next = append(next, data[idx:]...)
+			}
+			p, err := NewPatch(doc, site, next)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		return doc
+	}
+
+	roundTrip := func(doc *Document, opts ...position.Option) *Document {
+		var buf bytes.Buffer
+		n, err := doc.WriteTo(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(buf.Len())))
+		out, err := ReadFrom(&buf, opts...)
+		Expect(err).NotTo(HaveOccurred())
+		return out
+	}
+
+	It("round-trips the empty document", func() {
+		doc := NewDocument()
+		out := roundTrip(doc)
+		Expect(out.Uid).To(Equal(doc.Uid))
+		Expect(out.Length()).To(Equal(0))
+	})
+
+	It("round-trips atoms, positions, and tombstones", func() {
+		doc := buildDocument()
+		out := roundTrip(doc)
+		Expect(out.Uid).To(Equal(doc.Uid))
+		Expect(out.Data()).To(Equal(doc.Data()))
+		Expect(out.Tombstones()).To(Equal(doc.Tombstones()))
+		for k := 0; k < doc.Length(); k++ {
+			p, _ := doc.At(k)
+			q, _ := out.At(k)
+			Expect(q.Compare(p)).To(Equal(0))
+		}
+	})
+
+	It("round-trips the shape", func() {
+		shape := position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10, Boundary: 20}
+		out := roundTrip(buildDocument(WithAllocator(position.WithShape(shape))))
+		Expect(out.Shape()).To(Equal(shape))
+	})
+
+	It("round-trips allocation strategies", func() {
+		doc := buildDocument()
+		out := roundTrip(doc)
+		Expect(out.Length()).To(Equal(doc.Length()))
+
+		// both allocate identically when seeded identically
+		a := roundTrip(doc, position.WithSeed(1))
+		b := roundTrip(out, position.WithSeed(1))
+		for k := 0; k < 20; k++ {
+			p, err := a.Allocate(k, 1, site)
+			Expect(err).NotTo(HaveOccurred())
+			q, err := b.Allocate(k, 1, site)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q[0].String()).To(Equal(p[0].String()))
+			a.Insert(p[0], "x")
+			b.Insert(q[0], "x")
+		}
+	})
+
+	It("round-trips each strategy of the position package", func() {
+		for _, s := range []position.Strategy{
+			&position.LSEQ{Boundary: 5},
+			position.HashLSEQ{Seed: 42, Boundary: 7},
+			&position.HashLSEQ{Seed: 42},
+			position.Logoot{},
+			position.BoundaryPlus{Boundary: 3},
+			&position.BoundaryMinus{Boundary: 4},
+			position.Sequential{},
+		} {
+			doc := buildDocument(WithAllocator(position.WithStrategy(s)))
+
+			// both allocate identically when seeded identically
+			a := roundTrip(doc, position.WithSeed(1))
+			b := roundTrip(doc, position.WithSeed(1), position.WithStrategy(s))
+			for k := 0; k < 20; k++ {
+				p, err := a.Allocate(k, 1, site)
+				Expect(err).NotTo(HaveOccurred())
+				q, err := b.Allocate(k, 1, site)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p[0].String()).To(Equal(q[0].String()), "%#v", s)
+				a.Insert(p[0], "x")
+				b.Insert(q[0], "x")
+			}
+		}
+	})
+
+	It("refuses to write custom strategies", func() {
+		doc := NewDocument(WithAllocator(position.WithStrategy(middle{})))
+		var buf bytes.Buffer
+		n, err := doc.WriteTo(&buf)
+		Expect(err).To(MatchError(ErrUnknownStrategy))
+		Expect(n).To(Equal(int64(0)))
+	})
+
+	It("lets peers bootstrap and keep applying patches", func() {
+		doc := buildDocument()
+		peer := roundTrip(doc)
+
+		p, err := NewPatch(doc, site, []string{"hello", "world"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = p.Apply(peer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peer.Data()).To(Equal([]string{"hello", "world"}))
+	})
+
+	It("keeps ignoring insertions of deleted atoms", func() {
+		doc := buildDocument()
+		pos, data := doc.At(3)
+		doc.Delete(pos)
+		peer := roundTrip(doc)
+		Expect(peer.Insert(pos, data)).To(BeFalse())
+	})
+
+	It("keeps ignoring re-applied patches", func() {
+		doc := buildDocument()
+		p, _ := NewPatch(doc, site, []string{"hello"})
+		_, err := p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+		q, _ := NewPatch(doc, site, []string{"world"})
+		_, err = q.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+
+		peer := roundTrip(doc)
+		Expect(peer.Applied(p.ID())).To(BeTrue())
+		_, err = p.Apply(peer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peer.Data()).To(Equal([]string{"world"}))
+	})
+
+	It("reports write errors", func() {
+		var buf bytes.Buffer
+		_, err := buildDocument().WriteTo(&buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		w := &failingWriter{n: buf.Len() / 2}
+		n, err := buildDocument().WriteTo(w)
+		Expect(err).To(MatchError("disk full"))
+		Expect(n).To(BeNumerically("<=", buf.Len()/2))
+	})
+
+	Describe("ReadFrom", func() {
+		var buf []byte
+		BeforeEach(func() {
+			var out bytes.Buffer
+			buildDocument().WriteTo(&out)
+			buf = out.Bytes()
+		})
+
+		It("rejects unknown versions", func() {
+			buf[0] = 42
+			_, err := ReadFrom(bytes.NewReader(buf))
+			Expect(err).To(Equal(VersionError(42)))
+		})
+
+		It("rejects truncated input", func() {
+			for n := 0; n < len(buf); n += 7 {
+				_, err := ReadFrom(bytes.NewReader(buf[:n]))
+				Expect(err).To(HaveOccurred())
+			}
+			_, err := ReadFrom(bytes.NewReader(buf[:len(buf)-1]))
+			Expect(err).To(MatchError(ErrTruncated))
+		})
+
+		It("rejects corrupted input", func() {
+			for n := 1; n < len(buf); n += 7 {
+				corrupt := append([]byte{}, buf...)
+				corrupt[n] ^= 0x01
+				_, err := ReadFrom(bytes.NewReader(corrupt))
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("stops at the end of the snapshot", func() {
+			r := bytes.NewReader(append(buf, "trailing"...))
+			doc, err := ReadFrom(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(doc.Length()).To(Equal(buildDocument().Length()))
+			rest, _ := io.ReadAll(r)
+			Expect(string(rest)).To(Equal("trailing"))
+		})
+
+		It("leaves patches following the snapshot to read", func() {
+			doc := buildDocument()
+			p, err := NewPatch(doc, site, []string{"hello"})
+			Expect(err).NotTo(HaveOccurred())
+			patch, _ := p.MarshalBinary()
+
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(buf), bytes.NewReader(patch)))
+			peer, err := ReadFrom(r)
+			Expect(err).NotTo(HaveOccurred())
+			rest, _ := io.ReadAll(r)
+			q := new(Patch)
+			Expect(q.UnmarshalBinary(rest)).To(Succeed())
+			Expect(q.ID()).To(Equal(p.ID()))
+			Expect(peer.Length()).To(Equal(doc.Length()))
+		})
+	})
+})
@@ -0,0 +1,252 @@
+package document
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+)
+
+// Gravity is the side of a `Cursor` whose atom it is anchored to.
+type Gravity uint8
+
+const (
+	// GravityLeft anchors cursors to the atom before them, so that text
+	// inserted at the cursor by others goes after it.
+	GravityLeft Gravity = iota
+	// GravityRight anchors cursors to the atom after them, so that text
+	// inserted at the cursor by others goes before it.
+	GravityRight
+)
+
+// String --
+// Implement `fmt.Stringer`, as "left" or "right".
+func (g Gravity) String() string {
+	if g == GravityRight {
+		return "right"
+	}
+	return "left"
+}
+
+// Cursor -
+// A place between two atoms of a document, eg. a caret; anchored to the
+// position of one of them, or to a sentinel at either end, so that it follows
+// concurrent edits. See `Snapshot.Cursor` and `Snapshot.Resolve`.
+type Cursor struct {
+	Pos     *position.Position
+	Gravity Gravity
+}
+
+// Selection -
+// The atoms between two cursors: `Anchor`, where the selection started, and
+// `Head`, where it ends; which comes first for selections made backwards. A
+// lone caret is a selection with equal ends.
+type Selection struct {
+	Anchor Cursor
+	Head   Cursor
+}
+
+// Cursor returns a cursor before the atom indexed `idx`, or at the end of the
+// snapshot if `idx` is its length.
+func (s *Snapshot) Cursor(idx int, gravity Gravity) Cursor {
+	if idx < 0 || idx > s.Length() {
+		panic("index out of bounds")
+	}
+	// with the head sentinel, the atom before is indexed `idx` in the tree
+	if gravity == GravityLeft {
+		return Cursor{s.atoms.at(idx).pos, gravity}
+	}
+	return Cursor{s.atoms.at(idx + 1).pos, gravity}
+}
+
+// Select returns a selection from the cursor before the atom indexed `anchor`
+// to the one before that indexed `head`.
+//
+// Its first end has right gravity, and its last end left gravity, so that
+// text inserted at its ends does not extend it; carets have left gravity.
+func (s *Snapshot) Select(anchor int, head int) Selection {
+	switch {
+	case anchor < head:
+		return Selection{s.Cursor(anchor, GravityRight), s.Cursor(head, GravityLeft)}
+	case anchor > head:
+		return Selection{s.Cursor(anchor, GravityLeft), s.Cursor(head, GravityRight)}
+	}
+	c := s.Cursor(anchor, GravityLeft)
+	return Selection{c, c}
+}
+
+// Resolve returns the index of the atom after `c`, or the length of the
+// snapshot if it is at the end. Takes O(log n) time.
+//
+// If the atom `c` is anchored to was deleted, it snaps to its nearest
+// survivor, on the same side as the anchor: the cursor is then between the
+// atoms that surrounded the anchor. So is it if the anchor was not inserted
+// yet, eg. when a peer's cursor arrives before its patch.
+//
+// Returns -1 if `c` is of another shape.
+func (s *Snapshot) Resolve(c Cursor) int {
+	if !c.Pos.Shape().Compatible(s.shape) {
+		return -1
+	}
+	// the number of atoms before `c.Pos`, minus one for the head sentinel
+	idx, a := s.atoms.search(c.Pos)
+	idx--
+	if c.Gravity == GravityLeft && a != nil && a.pos.Compare(c.Pos) == 0 {
+		idx++
+	}
+	return min(max(idx, 0), s.Length())
+}
+
+// ResolveSelection returns the indices of the ends of `sel`; see `Resolve`.
+func (s *Snapshot) ResolveSelection(sel Selection) (anchor int, head int) {
+	return s.Resolve(sel.Anchor), s.Resolve(sel.Head)
+}
+
+// Cursor returns a cursor before the atom indexed `idx`; see
+// `Snapshot.Cursor`.
+func (doc *Document) Cursor(idx int, gravity Gravity) Cursor {
+	return doc.Snapshot().Cursor(idx, gravity)
+}
+
+// Select returns a selection between two cursors; see `Snapshot.Select`.
+func (doc *Document) Select(anchor int, head int) Selection {
+	return doc.Snapshot().Select(anchor, head)
+}
+
+// Resolve returns the current index of `c`; see `Snapshot.Resolve`.
+func (doc *Document) Resolve(c Cursor) int {
+	return doc.Snapshot().Resolve(c)
+}
+
+// ResolveSelection returns the current indices of the ends of `sel`.
+func (doc *Document) ResolveSelection(sel Selection) (anchor int, head int) {
+	return doc.Snapshot().ResolveSelection(sel)
+}
+
+// Returns true iff `c` can be resolved in the document.
+func (doc *Document) anchors(c Cursor) bool {
+	if c.Gravity > GravityRight || !doc.fits(c.Pos) {
+		return false
+	}
+	err := c.Pos.Validate()
+	return err == nil || err == position.ErrSentinel
+}
+
+// The order of the presence updates of a site: by `Epoch`, then `Seq`.
+type stamp struct {
+	epoch uint64
+	seq   uint64
+}
+
+// Returns true iff `s` orders before `t`.
+func (s stamp) before(t stamp) bool {
+	return s.epoch < t.epoch || (s.epoch == t.epoch && s.seq < t.seq)
+}
+
+// The last epoch returned by `newEpoch`.
+var lastEpoch atomic.Uint64
+
+// Return the epoch of the presence updates of a new document: the current
+// time in nanoseconds, or later than that of documents created before if the
+// clock is too coarse.
+func newEpoch() uint64 {
+	for {
+		last, now := lastEpoch.Load(), uint64(time.Now().UnixNano())
+		if now <= last {
+			now = last + 1
+		}
+		if lastEpoch.CompareAndSwap(last, now) {
+			return now
+		}
+	}
+}
+
+// The last presence update of a site.
+type presence struct {
+	stamp
+	sel *Selection // nil once the peer left
+}
+
+// PresenceUpdate -
+// The selection of a peer in a document, to send to other peers alongside
+// patches; or, if `Selection` is nil, a notice that the peer left.
+//
+// Updates of each site are ordered by `Epoch`, then `Seq`, so that updates
+// reordered in transit do not overwrite later ones. As `Seq` counts in memory
+// only, `Epoch` is the time the document creating the update was created or
+// restored at, or the `Epoch` of a later update of the site it applied: so
+// updates created after a restart are later than those created before.
+// Presence is ephemeral: it is not part of document snapshots, nor of undo
+// history.
+type PresenceUpdate struct {
+	Site      uid.Uid
+	Epoch     uint64
+	Seq       uint64
+	Selection *Selection
+}
+
+// The order of the update among those of its site.
+func (u *PresenceUpdate) stamp() stamp {
+	return stamp{u.Epoch, u.Seq}
+}
+
+// NewPresenceUpdate returns an update setting the selection of `site` to
+// `sel`, or removing it if nil; following the last update of `site` created
+// with, or applied to, the document. So each call returns a later update,
+// even before updates are applied; which, like patches, they are not yet.
+func (doc *Document) NewPresenceUpdate(site uid.Uid, sel *Selection) *PresenceUpdate {
+	last := stamp{epoch: doc.epoch}
+	if s, ok := doc.presenceStamps[site]; ok && last.before(s) {
+		last = s
+	}
+	if p, ok := doc.presence[site]; ok && last.before(p.stamp) {
+		last = p.stamp
+	}
+	last.seq++
+	doc.presenceStamps[site] = last
+	return &PresenceUpdate{Site: site, Epoch: last.epoch, Seq: last.seq, Selection: sel}
+}
+
+// Apply records the update in the presence map of `doc`.
+//
+// Returns false, recording nothing, if `doc` applied an update of the same
+// site that is not earlier already; or if the selection cannot be resolved in
+// `doc`, eg. as it is of another shape.
+func (u *PresenceUpdate) Apply(doc *Document) bool {
+	if p, ok := doc.presence[u.Site]; ok && !p.before(u.stamp()) {
+		return false
+	}
+	if u.Selection != nil && !(doc.anchors(u.Selection.Anchor) && doc.anchors(u.Selection.Head)) {
+		return false
+	}
+	p := &presence{stamp: u.stamp()}
+	if u.Selection != nil {
+		sel := *u.Selection
+		p.sel = &sel
+	}
+	doc.presence[u.Site] = p
+	return true
+}
+
+// Presence returns the selection of `site` in the document, and true; or
+// false if it has none, eg. as it left.
+func (doc *Document) Presence(site uid.Uid) (Selection, bool) {
+	if p, ok := doc.presence[site]; ok && p.sel != nil {
+		return *p.sel, true
+	}
+	return Selection{}, false
+}
+
+// Peers returns the sites with a selection in the document, in order.
+func (doc *Document) Peers() []uid.Uid {
+	out := make([]uid.Uid, 0, len(doc.presence))
+	for site, p := range doc.presence {
+		if p.sel != nil {
+			out = append(out, site)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,360 @@
+package document_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Presence", func() {
+	site := uid.Uid(0xF00F00F0)
+	var doc *Document
+
+	BeforeEach(func() {
+		doc = NewDocument(WithAllocator(position.WithSeed(1)))
+		p, err := NewPatch(doc, site, []string{"a", "b", "c", "d"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = p.Apply(doc)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	insert := func(idx int, data string) {
+		pos, err := doc.Allocate(idx, 1, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doc.Insert(pos[0], data)).To(BeTrue())
+	}
+
+	remove := func(idx int) {
+		pos, _ := doc.At(idx)
+		Expect(doc.Delete(pos)).To(BeTrue())
+	}
+
+	// Return a string representation of `sel`, to compare decoded selections.
+	describe := func(sel *Selection) string {
+		if sel == nil {
+			return "nil"
+		}
+		return sel.Anchor.Pos.String() + sel.Anchor.Gravity.String() + " " +
+			sel.Head.Pos.String() + sel.Head.Gravity.String()
+	}
+
+	Describe("Cursor", func() {
+		It("resolves to its index", func() {
+			for idx := 0; idx <= doc.Length(); idx++ {
+				Expect(doc.Resolve(doc.Cursor(idx, GravityLeft))).To(Equal(idx))
+				Expect(doc.Resolve(doc.Cursor(idx, GravityRight))).To(Equal(idx))
+			}
+		})
+
+		It("follows insertions before it", func() {
+			c := doc.Cursor(2, GravityLeft)
+			insert(0, "x")
+			insert(1, "y")
+			Expect(doc.Resolve(c)).To(Equal(4))
+		})
+
+		It("ignores insertions after it", func() {
+			c := doc.Cursor(2, GravityRight)
+			insert(3, "x")
+			insert(5, "y")
+			Expect(doc.Resolve(c)).To(Equal(2))
+		})
+
+		It("stays before insertions at it with left gravity", func() {
+			c := doc.Cursor(2, GravityLeft)
+			insert(2, "x")
+			Expect(doc.Resolve(c)).To(Equal(2))
+		})
+
+		It("goes after insertions at it with right gravity", func() {
+			c := doc.Cursor(2, GravityRight)
+			insert(2, "x")
+			Expect(doc.Resolve(c)).To(Equal(3))
+		})
+
+		It("stays at the ends of the document", func() {
+			start, end := doc.Cursor(0, GravityLeft), doc.Cursor(4, GravityRight)
+			insert(0, "x")
+			insert(5, "y")
+			Expect(doc.Resolve(start)).To(Equal(0))
+			Expect(doc.Resolve(end)).To(Equal(6))
+		})
+
+		It("snaps to the nearest survivor when its anchor is deleted", func() {
+			left, right := doc.Cursor(2, GravityLeft), doc.Cursor(2, GravityRight)
+			remove(1) // "b", the anchor of `left`
+			Expect(doc.Resolve(left)).To(Equal(1))
+			Expect(doc.Data()[1]).To(Equal("c"))
+			remove(1) // "c", the anchor of `right`
+			Expect(doc.Resolve(right)).To(Equal(1))
+			Expect(doc.Data()[1]).To(Equal("d"))
+			Expect(doc.Resolve(left)).To(Equal(1))
+		})
+
+		It("snaps to the start or end when all atoms are deleted", func() {
+			first, last := doc.Cursor(1, GravityLeft), doc.Cursor(3, GravityRight)
+			for doc.Length() > 0 {
+				remove(0)
+			}
+			Expect(doc.Resolve(first)).To(Equal(0))
+			Expect(doc.Resolve(last)).To(Equal(0))
+		})
+
+		It("resolves anchors not inserted yet", func() {
+			local, remote := NewDocument(), NewDocument(WithAllocator(position.WithSeed(2)))
+			p, _ := NewPatch(remote, site+1, []string{"a", "b", "c", "d"})
+			p.Apply(local)
+			p.Apply(remote)
+			q, _ := NewPatch(remote, site+1, []string{"a", "b", "x", "c", "d"})
+			q.Apply(remote)
+			c := remote.Cursor(3, GravityLeft)
+
+			Expect(local.Resolve(c)).To(Equal(2))
+			q.Apply(local)
+			Expect(local.Resolve(c)).To(Equal(3))
+		})
+
+		It("resolves in snapshots", func() {
+			c := doc.Cursor(2, GravityRight)
+			s := doc.Snapshot()
+			insert(0, "x")
+			Expect(s.Resolve(c)).To(Equal(2))
+			Expect(doc.Resolve(c)).To(Equal(3))
+		})
+
+		It("does not resolve positions of another shape", func() {
+			other := NewDocument(WithAllocator(position.WithShape(position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10})))
+			Expect(doc.Resolve(other.Cursor(0, GravityLeft))).To(Equal(-1))
+		})
+
+		It("panics out of bounds", func() {
+			Expect(func() { doc.Cursor(5, GravityLeft) }).To(Panic())
+			Expect(func() { doc.Cursor(-1, GravityRight) }).To(Panic())
+		})
+	})
+
+	Describe("Selection", func() {
+		It("resolves to its ends", func() {
+			anchor, head := doc.ResolveSelection(doc.Select(1, 3))
+			Expect([]int{anchor, head}).To(Equal([]int{1, 3}))
+			anchor, head = doc.ResolveSelection(doc.Select(3, 1))
+			Expect([]int{anchor, head}).To(Equal([]int{3, 1}))
+		})
+
+		It("does not grow with insertions at its ends", func() {
+			sel := doc.Select(1, 3)
+			insert(3, "x")
+			insert(1, "y")
+			anchor, head := doc.ResolveSelection(sel)
+			Expect(doc.Slice(anchor, head)).To(Equal([]string{"b", "c"}))
+		})
+
+		It("collapses when its atoms are deleted", func() {
+			sel := doc.Select(3, 1)
+			remove(2)
+			remove(1)
+			anchor, head := doc.ResolveSelection(sel)
+			Expect([]int{anchor, head}).To(Equal([]int{1, 1}))
+		})
+
+		It("is a caret with equal ends", func() {
+			sel := doc.Select(2, 2)
+			Expect(sel.Anchor).To(Equal(sel.Head))
+			insert(2, "x")
+			anchor, head := doc.ResolveSelection(sel)
+			Expect([]int{anchor, head}).To(Equal([]int{2, 2}))
+		})
+	})
+
+	Describe("PresenceUpdate", func() {
+		It("records selections by site", func() {
+			sel := doc.Select(1, 2)
+			Expect(doc.NewPresenceUpdate(site+2, &sel).Apply(doc)).To(BeTrue())
+			caret := doc.Select(0, 0)
+			Expect(doc.NewPresenceUpdate(site+1, &caret).Apply(doc)).To(BeTrue())
+
+			Expect(doc.Peers()).To(Equal([]uid.Uid{site + 1, site + 2}))
+			got, ok := doc.Presence(site + 2)
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(sel))
+			_, ok = doc.Presence(site)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("replaces earlier updates", func() {
+			a, b := doc.Select(0, 1), doc.Select(2, 3)
+			Expect(doc.NewPresenceUpdate(site, &a).Apply(doc)).To(BeTrue())
+			Expect(doc.NewPresenceUpdate(site, &b).Apply(doc)).To(BeTrue())
+			got, _ := doc.Presence(site)
+			Expect(got).To(Equal(b))
+		})
+
+		It("numbers updates not applied yet in turn", func() {
+			a, b := doc.Select(0, 1), doc.Select(2, 3)
+			first, second := doc.NewPresenceUpdate(site, &a), doc.NewPresenceUpdate(site, &b)
+			Expect(second.Seq).To(BeNumerically(">", first.Seq))
+			Expect(second.Apply(doc)).To(BeTrue())
+			Expect(first.Apply(doc)).To(BeFalse())
+
+			// and after updates applied from elsewhere
+			remote := &PresenceUpdate{Site: site, Epoch: second.Epoch, Seq: second.Seq + 10, Selection: &a}
+			Expect(remote.Apply(doc)).To(BeTrue())
+			next := doc.NewPresenceUpdate(site, &b)
+			Expect(next.Epoch).To(Equal(remote.Epoch))
+			Expect(next.Seq).To(Equal(remote.Seq + 1))
+		})
+
+		It("ignores stale updates", func() {
+			a, b := doc.Select(0, 1), doc.Select(2, 3)
+			first := doc.NewPresenceUpdate(site, &a)
+			second := &PresenceUpdate{Site: site, Epoch: first.Epoch, Seq: first.Seq + 1, Selection: &b}
+			Expect(second.Apply(doc)).To(BeTrue())
+			Expect(first.Apply(doc)).To(BeFalse())
+			Expect(second.Apply(doc)).To(BeFalse())
+			got, _ := doc.Presence(site)
+			Expect(got).To(Equal(b))
+
+			// of earlier epochs, whatever their `Seq`
+			earlier := &PresenceUpdate{Site: site, Epoch: first.Epoch - 1, Seq: first.Seq + 100, Selection: &a}
+			Expect(earlier.Apply(doc)).To(BeFalse())
+		})
+
+		It("orders updates created after a restart later", func() {
+			a, b, c := doc.Select(0, 1), doc.Select(2, 3), doc.Select(1, 4)
+			peer := NewDocument()
+			for k := 0; k < 3; k++ {
+				Expect(doc.NewPresenceUpdate(site, &a).Apply(peer)).To(BeTrue())
+			}
+
+			var buf bytes.Buffer
+			_, err := doc.WriteTo(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			restored, err := ReadFrom(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			u := restored.NewPresenceUpdate(site, &b)
+			Expect(u.Seq).To(Equal(uint64(1)))
+			Expect(u.Apply(peer)).To(BeTrue())
+
+			restarted := NewDocument()
+			Expect(restarted.NewPresenceUpdate(site, &c).Apply(peer)).To(BeTrue())
+			got, _ := peer.Presence(site)
+			Expect(describe(&got)).To(Equal(describe(&c)))
+		})
+
+		It("removes peers that left", func() {
+			sel := doc.Select(0, 1)
+			Expect(doc.NewPresenceUpdate(site, &sel).Apply(doc)).To(BeTrue())
+			left := doc.NewPresenceUpdate(site, nil)
+			Expect(left.Apply(doc)).To(BeTrue())
+			Expect(doc.Peers()).To(BeEmpty())
+			_, ok := doc.Presence(site)
+			Expect(ok).To(BeFalse())
+
+			stale := &PresenceUpdate{Site: site, Epoch: left.Epoch, Seq: left.Seq - 1, Selection: &sel}
+			Expect(stale.Apply(doc)).To(BeFalse())
+		})
+
+		It("rejects selections of another shape", func() {
+			other := NewDocument(WithAllocator(position.WithShape(position.TreeShape{RootBits: 8, Growth: 2, MaxDigits: 10})))
+			sel := other.Select(0, 0)
+			Expect(doc.NewPresenceUpdate(site, &sel).Apply(doc)).To(BeFalse())
+			Expect(doc.Peers()).To(BeEmpty())
+		})
+
+		It("rejects unknown gravities", func() {
+			sel := doc.Select(0, 1)
+			sel.Head.Gravity = 42
+			Expect(doc.NewPresenceUpdate(site, &sel).Apply(doc)).To(BeFalse())
+		})
+	})
+
+	Describe("PresenceUpdate encoding", func() {
+		var updates []*PresenceUpdate
+
+		BeforeEach(func() {
+			sel, caret := doc.Select(3, 1), doc.Select(4, 4)
+			updates = []*PresenceUpdate{
+				{Site: site, Epoch: 0x1862F0A5C0DE0000, Seq: 1, Selection: &sel},
+				{Site: site + 1, Epoch: 42, Seq: 300, Selection: &caret},
+				{Site: site, Epoch: 0x1862F0A5C0DE0000, Seq: 2},
+			}
+		})
+
+		It("round-trips binary", func() {
+			for _, u := range updates {
+				buf, err := u.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				v := new(PresenceUpdate)
+				Expect(v.UnmarshalBinary(buf)).To(Succeed())
+				Expect(v.Site).To(Equal(u.Site))
+				Expect(v.Epoch).To(Equal(u.Epoch))
+				Expect(v.Seq).To(Equal(u.Seq))
+				Expect(describe(v.Selection)).To(Equal(describe(u.Selection)))
+			}
+		})
+
+		It("round-trips JSON", func() {
+			for _, u := range updates {
+				buf, err := json.Marshal(u)
+				Expect(err).NotTo(HaveOccurred())
+				v := new(PresenceUpdate)
+				Expect(json.Unmarshal(buf, v)).To(Succeed())
+				Expect(v.Site).To(Equal(u.Site))
+				Expect(v.Epoch).To(Equal(u.Epoch))
+				Expect(v.Seq).To(Equal(u.Seq))
+				Expect(describe(v.Selection)).To(Equal(describe(u.Selection)))
+			}
+		})
+
+		It("decodes to updates that apply", func() {
+			buf, _ := updates[0].MarshalBinary()
+			v := new(PresenceUpdate)
+			Expect(v.UnmarshalBinary(buf)).To(Succeed())
+			Expect(v.Apply(doc)).To(BeTrue())
+			anchor, head := doc.ResolveSelection(*v.Selection)
+			Expect([]int{anchor, head}).To(Equal([]int{3, 1}))
+		})
+
+		It("rejects truncated input", func() {
+			buf, _ := updates[0].MarshalBinary()
+			Expect(new(PresenceUpdate).UnmarshalBinary(nil)).To(MatchError(ErrTruncated))
+			for n := 1; n < len(buf); n++ {
+				Expect(new(PresenceUpdate).UnmarshalBinary(buf[:n])).NotTo(Succeed())
+			}
+		})
+
+		It("rejects corrupted input", func() {
+			buf, _ := updates[0].MarshalBinary()
+			for n := 1; n < len(buf); n++ {
+				corrupt := append([]byte{}, buf...)
+				corrupt[n] ^= 0x10
+				Expect(new(PresenceUpdate).UnmarshalBinary(corrupt)).To(MatchError(ErrChecksum))
+			}
+		})
+
+		It("rejects unknown versions", func() {
+			buf, _ := updates[0].MarshalBinary()
+			buf[0] = 42
+			Expect(new(PresenceUpdate).UnmarshalBinary(buf)).To(Equal(VersionError(42)))
+			Expect(json.Unmarshal([]byte(`{"version":42}`), new(PresenceUpdate))).To(Equal(VersionError(42)))
+		})
+
+		It("rejects JSON checksum mismatches", func() {
+			buf, _ := json.Marshal(updates[1])
+			buf = bytes.Replace(buf, []byte(`"seq":300`), []byte(`"seq":301`), 1)
+			Expect(json.Unmarshal(buf, new(PresenceUpdate))).To(MatchError(ErrChecksum))
+		})
+
+		It("rejects unknown JSON gravities", func() {
+			buf, _ := json.Marshal(updates[0])
+			buf = bytes.Replace(buf, []byte(`"right"`), []byte(`"up"`), 1)
+			Expect(json.Unmarshal(buf, new(PresenceUpdate))).To(MatchError(ErrMalformed))
+		})
+	})
+})
@@ -0,0 +1,76 @@
+package document
+
+import "github.com/mezis/lseq/position"
+
+// Snapshot -
+// A read-only view of a document at some point in time, unaffected by later
+// changes to it; eg. to render, search, or export it while edits keep
+// arriving. Safe for concurrent use.
+type Snapshot struct {
+	atoms *node // including sentinels
+	shape position.TreeShape
+}
+
+// Snapshot returns a view of the document as it is now, in O(1) time: the
+// document's atoms are kept in a persistent tree, which snapshots share with
+// it and with each other.
+func (doc *Document) Snapshot() *Snapshot {
+	return &Snapshot{atoms: doc.atoms, shape: doc.alloc.Shape()}
+}
+
+// Length returns the number of atoms in the snapshot.
+func (s *Snapshot) Length() int {
+	return s.atoms.len() - 2
+}
+
+// At returns the atom indexed `idx`.
+func (s *Snapshot) At(idx int) (*position.Position, string) {
+	if idx < 0 || idx >= s.Length() {
+		panic("index out of bounds")
+	}
+	a := s.atoms.at(idx + 1)
+	return a.pos, a.data
+}
+
+// Each iterates through atoms, passing them to the "cb" callback.
+func (s *Snapshot) Each(cb func(number uint, pos *position.Position, data string)) {
+	k := uint(0)
+	eachAtom(s.atoms, func(a *atom) {
+		cb(k, a.pos, a.data)
+		k++
+	})
+}
+
+// Data returns all the atom data in the snapshot, in order.
+func (s *Snapshot) Data() []string {
+	out := make([]string, 0, s.Length())
+	eachAtom(s.atoms, func(a *atom) {
+		out = append(out, a.data)
+	})
+	return out
+}
+
+// IndexOf returns the index of the atom at `pos`, and true; or false if there
+// is none. Takes O(log n) time.
+func (s *Snapshot) IndexOf(pos *position.Position) (int, bool) {
+	if !pos.Shape().Compatible(s.shape) {
+		return -1, false
+	}
+	idx, a := s.atoms.search(pos)
+	if idx < 1 || idx > s.Length() || a.pos.Compare(pos) != 0 {
+		return -1, false
+	}
+	return idx - 1, true
+}
+
+// Nearest returns the index of the atom at `pos` or, if there is none, of the
+// first atom after it, or else of the last atom. Takes O(log n) time.
+//
+// Returns -1 if the snapshot is empty, or `pos` is of another shape.
+func (s *Snapshot) Nearest(pos *position.Position) int {
+	if !pos.Shape().Compatible(s.shape) {
+		return -1
+	}
+	idx, _ := s.atoms.search(pos)
+	return min(max(idx-1, 0), s.Length()-1)
+}
@@ -0,0 +1,90 @@
+package document_test
+
+import (
+	"fmt"
+	"math/rand"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Document.Snapshot", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	It("is empty for empty documents", func() {
+		s := NewDocument().Snapshot()
+		Expect(s.Length()).To(Equal(0))
+		Expect(s.Data()).To(BeEmpty())
+		Expect(s.Nearest(position.DefaultShape().Tail())).To(Equal(-1))
+	})
+
+	It("reads like the document", func() {
+		doc := NewDocument()
+		p, _ := NewPatch(doc, site, []string{"hello", "beautiful", "world"})
+		p.Apply(doc)
+
+		s := doc.Snapshot()
+		Expect(s.Length()).To(Equal(3))
+		Expect(s.Data()).To(Equal(doc.Data()))
+		s.Each(func(k uint, pos *position.Position, data string) {
+			q, d := doc.At(int(k))
+			Expect(pos).To(Equal(q))
+			Expect(data).To(Equal(d))
+
+			idx, ok := s.IndexOf(pos)
+			Expect(ok).To(BeTrue())
+			Expect(idx).To(Equal(int(k)))
+			Expect(s.Nearest(pos)).To(Equal(int(k)))
+		})
+	})
+
+	It("is unaffected by later changes", func() {
+		rnd := rand.New(rand.NewSource(1))
+		doc := NewDocument(WithAllocator(position.WithSeed(1)))
+		snapshots := []*Snapshot{}
+		states := [][]string{}
+		for k := 0; k < 300; k++ {
+			snapshots = append(snapshots, doc.Snapshot())
+			states = append(states, doc.Data())
+
+			if n := doc.Length(); n > 0 && rnd.Intn(3) == 0 {
+				pos, _ := doc.At(rnd.Intn(n))
+				Expect(doc.Delete(pos)).To(BeTrue())
+			} else {
+				pos, err := doc.Allocate(rnd.Intn(n+1), 1, site)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(doc.Insert(pos[0], fmt.Sprintf("edit %d", k))).To(BeTrue())
+			}
+		}
+		for k, s := range snapshots {
+			Expect(s.Data()).To(Equal(states[k]))
+			Expect(s.Length()).To(Equal(len(states[k])))
+			for idx := range states[k] {
+				pos, data := s.At(idx)
+				Expect(data).To(Equal(states[k][idx]))
+				got, ok := s.IndexOf(pos)
+				Expect(ok).To(BeTrue())
+				Expect(got).To(Equal(idx))
+			}
+		}
+	})
+
+	It("does not find positions added or deleted since", func() {
+		doc := NewDocument()
+		pos, _ := doc.Allocate(0, 2, site)
+		doc.Insert(pos[0], "hello")
+		s := doc.Snapshot()
+		doc.Insert(pos[1], "world")
+		doc.Delete(pos[0])
+
+		_, ok := s.IndexOf(pos[1])
+		Expect(ok).To(BeFalse())
+		idx, ok := s.IndexOf(pos[0])
+		Expect(ok).To(BeTrue())
+		Expect(idx).To(Equal(0))
+	})
+})
@@ -0,0 +1,188 @@
+package document
+
+import (
+	"io"
+	"sync"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+)
+
+// SyncDocument -
+// Wraps a document for concurrent use: any number of goroutines may read it
+// at once, eg. HTTP handlers, while one at a time changes it, eg. applying
+// patches from the network.
+//
+// Allocating positions changes the document's allocator, so `Allocate` and
+// `NewPatch` are writes. Other uses of the document, eg. by a `Text` or an
+// `UndoManager`, go through `View` and `Update`.
+type SyncDocument struct {
+	mu  sync.RWMutex
+	doc *Document
+}
+
+// NewSyncDocument wraps `doc`, which must not be used directly afterwards.
+func NewSyncDocument(doc *Document) *SyncDocument {
+	return &SyncDocument{doc: doc}
+}
+
+// View calls `fn` with the document, which it must not change, while holding
+// a read lock.
+func (s *SyncDocument) View(fn func(*Document)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(s.doc)
+}
+
+// Update calls `fn` with the document while holding the write lock, and
+// returns its error.
+func (s *SyncDocument) Update(fn func(*Document) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.doc)
+}
+
+// Snapshot returns a view of the document as it is now, for readers to use
+// without holding any lock; see `Document.Snapshot`.
+func (s *SyncDocument) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Snapshot()
+}
+
+// Apply applies `p` to the document; see `Patch.Apply`.
+func (s *SyncDocument) Apply(p *Patch) (ApplyResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Apply(s.doc)
+}
+
+// NewPatch returns a patch transforming the document into `data`; see
+// `NewPatch`.
+func (s *SyncDocument) NewPatch(site uid.Uid, data []string) (*Patch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewPatch(s.doc, site, data)
+}
+
+// ApplyPresence records a peer's selection; see `PresenceUpdate.Apply`.
+func (s *SyncDocument) ApplyPresence(u *PresenceUpdate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return u.Apply(s.doc)
+}
+
+// NewPresenceUpdate returns an update setting the selection of `site`; see
+// `Document.NewPresenceUpdate`. As it counts updates, it is a write.
+func (s *SyncDocument) NewPresenceUpdate(site uid.Uid, sel *Selection) *PresenceUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.NewPresenceUpdate(site, sel)
+}
+
+// Allocate returns positions before the atom at index `idx`; see
+// `Document.Allocate`.
+func (s *SyncDocument) Allocate(idx int, count int, site uid.Uid) ([]*position.Position, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.Allocate(idx, count, site)
+}
+
+// Insert adds an atom; see `Document.Insert`.
+func (s *SyncDocument) Insert(pos *position.Position, data string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.Insert(pos, data)
+}
+
+// Delete removes an atom; see `Document.Delete`.
+func (s *SyncDocument) Delete(pos *position.Position) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.Delete(pos)
+}
+
+// Subscribe calls `cb` with later changes; see `Document.Subscribe`. As `cb`
+// is called while the write lock is held, it must not use `s`.
+func (s *SyncDocument) Subscribe(cb func(Event)) (cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel = s.doc.Subscribe(cb)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cancel()
+	}
+}
+
+// Length returns the number of atoms; see `Document.Length`.
+func (s *SyncDocument) Length() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Length()
+}
+
+// Data returns the data of all atoms; see `Document.Data`.
+func (s *SyncDocument) Data() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Data()
+}
+
+// At returns the atom indexed `idx`; see `Document.At`.
+func (s *SyncDocument) At(idx int) (*position.Position, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.At(idx)
+}
+
+// Each iterates through atoms while holding a read lock, so `cb` must not
+// change the document; see `Document.Each`.
+func (s *SyncDocument) Each(cb func(number uint, pos *position.Position, data string)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.doc.Each(cb)
+}
+
+// EachRange iterates through some atoms while holding a read lock, so `cb`
+// must not change the document; see `Document.EachRange`.
+func (s *SyncDocument) EachRange(from int, to int, cb func(number uint, pos *position.Position, data string)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.doc.EachRange(from, to, cb)
+}
+
+// Slice returns the data of some atoms; see `Document.Slice`.
+func (s *SyncDocument) Slice(from int, to int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Slice(from, to)
+}
+
+// IndexOf returns the index of the atom at `pos`; see `Document.IndexOf`.
+func (s *SyncDocument) IndexOf(pos *position.Position) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.IndexOf(pos)
+}
+
+// Presence returns the selection of `site`; see `Document.Presence`.
+func (s *SyncDocument) Presence(site uid.Uid) (Selection, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Presence(site)
+}
+
+// Peers returns the sites with a selection; see `Document.Peers`.
+func (s *SyncDocument) Peers() []uid.Uid {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.Peers()
+}
+
+// WriteTo writes a snapshot of the document; see `Document.WriteTo`.
+func (s *SyncDocument) WriteTo(w io.Writer) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc.WriteTo(w)
+}
@@ -0,0 +1,159 @@
+package document_test
+
+import (
+	"fmt"
+	"sync"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyncDocument", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	// Patches from a remote site, each appending a line.
+	remotePatches := func(n int) []*Patch {
+		remote := NewDocument(WithAllocator(position.WithSeed(1)))
+		out := []*Patch{}
+		for k := 0; k < n; k++ {
+			p, err := NewPatch(remote, site+1, append(remote.Data(), fmt.Sprintf("line %d", k)))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(remote)
+			Expect(err).NotTo(HaveOccurred())
+			out = append(out, p)
+		}
+		return out
+	}
+
+	It("wraps a document", func() {
+		s := NewSyncDocument(NewDocument())
+		p, err := s.NewPatch(site, []string{"hello", "world"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = s.Apply(p)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Data()).To(Equal([]string{"hello", "world"}))
+		Expect(s.Length()).To(Equal(2))
+
+		pos, data := s.At(1)
+		Expect(data).To(Equal("world"))
+		idx, ok := s.IndexOf(pos)
+		Expect(ok).To(BeTrue())
+		Expect(idx).To(Equal(1))
+		Expect(s.Delete(pos)).To(BeTrue())
+		Expect(s.Insert(pos, "world")).To(BeFalse())
+
+		sel := s.Snapshot().Select(0, 1)
+		Expect(s.ApplyPresence(s.NewPresenceUpdate(site+1, &sel))).To(BeTrue())
+		Expect(s.Peers()).To(Equal([]uid.Uid{site + 1}))
+		got, ok := s.Presence(site + 1)
+		Expect(ok).To(BeTrue())
+		Expect(got).To(Equal(sel))
+
+		var length int
+		s.View(func(doc *Document) {
+			length = doc.Length()
+		})
+		Expect(length).To(Equal(1))
+	})
+
+	It("numbers presence updates created concurrently", func() {
+		s := NewSyncDocument(NewDocument())
+		seqs := make(chan uint64, 400)
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					seqs <- s.NewPresenceUpdate(site, nil).Seq
+				}
+			}()
+		}
+		wg.Wait()
+		close(seqs)
+
+		seen := map[uint64]bool{}
+		for seq := range seqs {
+			Expect(seen).NotTo(HaveKey(seq))
+			seen[seq] = true
+		}
+		Expect(seen).To(HaveLen(400))
+	})
+
+	It("has snapshots unaffected by later changes", func() {
+		s := NewSyncDocument(NewDocument())
+		for _, p := range remotePatches(3) {
+			s.Apply(p)
+		}
+		snap := s.Snapshot()
+		pos, _ := s.At(0)
+		s.Delete(pos)
+		Expect(snap.Data()).To(Equal([]string{"line 0", "line 1", "line 2"}))
+		Expect(s.Data()).To(Equal([]string{"line 1", "line 2"}))
+	})
+
+	It("can be read while written", func() {
+		patches := remotePatches(300)
+		s := NewSyncDocument(NewDocument())
+		events := 0
+		s.Subscribe(func(Event) { events++ })
+
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		run := func(fn func()) {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						fn()
+					}
+				}
+			}()
+		}
+
+		run(func() {
+			snap := s.Snapshot()
+			data := snap.Data()
+			for k := range data {
+				Expect(data[k]).To(Equal(fmt.Sprintf("line %d", k)))
+			}
+		})
+		run(func() {
+			n := uint(0)
+			s.Each(func(k uint, pos *position.Position, data string) {
+				Expect(k).To(Equal(n))
+				n++
+			})
+		})
+		run(func() {
+			if n := s.Length(); n > 0 {
+				pos, _ := s.At(n - 1)
+				_, ok := s.IndexOf(pos)
+				Expect(ok).To(BeTrue())
+			}
+		})
+		run(func() {
+			_, err := s.Allocate(s.Length()/2, 2, site)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		for _, p := range patches {
+			_, err := s.Apply(p)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		close(done)
+		wg.Wait()
+
+		Expect(s.Length()).To(Equal(300))
+		Expect(events).To(Equal(300))
+	})
+})
@@ -0,0 +1,84 @@
+package document
+
+import (
+	"strings"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+	"github.com/rivo/uniseg"
+)
+
+// Text -
+// A document whose atoms are grapheme clusters, ie. user-perceived
+// characters, for collaborative editing of prose; rather than lines, as
+// usually edited with `NewPatch`.
+//
+// Edits return the patches applied, for other replicas; which apply them like
+// any other, to a `Text` or a `Document` alike.
+//
+// Indices count atoms: each grapheme cluster of the strings inserted is an
+// atom, even if it combines with its neighbours once inserted, eg. a combining
+// accent typed after a letter.
+type Text struct {
+	*Document
+}
+
+// NewText returns a new, empty, text; see `NewDocument` for `opts`.
+func NewText(opts ...Option) *Text {
+	return &Text{NewDocument(opts...)}
+}
+
+// InsertString -
+// Insert the grapheme clusters of `s` before the one indexed `idx`, and return
+// the patch applied, from `site`.
+//
+// Like `NewPatch`, relocates the following atoms if there is no room left, and
+// returns `position.ErrExhausted`, changing nothing, if that fails.
+func (t *Text) InsertString(idx int, s string, site uid.Uid) (*Patch, error) {
+	if idx < 0 || idx > t.Length() {
+		panic("index out of bounds")
+	}
+	data := []string{}
+	for state := -1; len(s) > 0; {
+		var cluster string
+		cluster, s, _, state = uniseg.FirstGraphemeClusterInString(s, state)
+		data = append(data, cluster)
+	}
+
+	out := t.newPatch(site)
+	if _, _, err := out.addInsertions(t.Document, idx, nil, t.Length()-idx, data, site); err != nil {
+		return nil, err
+	}
+	if _, err := out.Apply(t.Document); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteRange -
+// Delete the `n` grapheme clusters from the one indexed `idx`, and return the
+// patch applied, from `site`.
+func (t *Text) DeleteRange(idx int, n int, site uid.Uid) (*Patch, error) {
+	if idx < 0 || n < 0 || idx+n > t.Length() {
+		panic("index out of bounds")
+	}
+	out := t.newPatch(site)
+	for k := idx; k < idx+n; k++ {
+		pos, data := t.At(k)
+		out.Add(OpDelete, pos, data)
+	}
+	if _, err := out.Apply(t.Document); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// String --
+// Implement `fmt.Stringer`, returning the text.
+func (t *Text) String() string {
+	var out strings.Builder
+	t.Each(func(_ uint, _ *position.Position, data string) {
+		out.WriteString(data)
+	})
+	return out.String()
+}
@@ -0,0 +1,113 @@
+package document_test
+
+import (
+	"math/rand"
+	"strings"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Text", func() {
+	site := uid.Uid(0xF00F00F0)
+
+	insert := func(t *Text, idx int, s string) *Patch {
+		p, err := t.InsertString(idx, s, site)
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+	remove := func(t *Text, idx int, n int) *Patch {
+		p, err := t.DeleteRange(idx, n, site)
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+
+	It("is empty at first", func() {
+		Expect(NewText().String()).To(Equal(""))
+	})
+
+	It("inserts and deletes characters", func() {
+		t := NewText()
+		insert(t, 0, "hello")
+		insert(t, 5, " world")
+		insert(t, 0, ">")
+		Expect(t.String()).To(Equal(">hello world"))
+		remove(t, 0, 1)
+		remove(t, 5, 6)
+		Expect(t.String()).To(Equal("hello"))
+		Expect(t.Length()).To(Equal(5))
+	})
+
+	It("keeps grapheme clusters together", func() {
+		t := NewText()
+		insert(t, 0, "née 🇫🇷 👩‍👩‍👧")
+		Expect(t.Length()).To(Equal(7))
+		remove(t, 1, 1)
+		remove(t, 3, 1)
+		Expect(t.String()).To(Equal("ne  👩‍👩‍👧"))
+	})
+
+	It("keeps invalid UTF-8 as is", func() {
+		t := NewText()
+		insert(t, 0, "a\xffb")
+		Expect(t.String()).To(Equal("a\xffb"))
+		Expect(t.Length()).To(Equal(3))
+	})
+
+	It("returns patches for other replicas", func() {
+		t, replica, doc := NewText(), NewText(), NewDocument()
+		for _, p := range []*Patch{insert(t, 0, "héllo"), remove(t, 1, 1), insert(t, 1, "e")} {
+			_, err := p.Apply(replica.Document)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.Apply(doc)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(replica.String()).To(Equal("hello"))
+		Expect(doc.Data()).To(Equal([]string{"h", "e", "l", "l", "o"}))
+	})
+
+	It("types characters again after deleting them", func() {
+		t, replica := NewText(WithAllocator(position.WithStrategy(position.Sequential{}))), NewText()
+		for _, p := range []*Patch{insert(t, 0, "a"), insert(t, 1, "b"), remove(t, 1, 1), insert(t, 1, "b")} {
+			res, err := p.Apply(replica.Document)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Redelivered).To(BeFalse())
+		}
+		Expect(t.String()).To(Equal("ab"))
+		Expect(replica.String()).To(Equal("ab"))
+	})
+
+	It("keeps typing forwards and backwards", func() {
+		t := NewText(WithAllocator(position.WithSeed(1)))
+		insert(t, 0, "[]")
+		for k := 0; k < 1000; k++ {
+			insert(t, 1+k, "a")
+		}
+		for k := 0; k < 1000; k++ {
+			insert(t, 1, "b")
+		}
+		Expect(t.String()).To(Equal("[" + strings.Repeat("b", 1000) + strings.Repeat("a", 1000) + "]"))
+	})
+
+	It("converges with concurrent edits", func() {
+		rnd := rand.New(rand.NewSource(1))
+		a, b := NewText(), NewText()
+		sites := []uid.Uid{site, site + 1}
+		for k := 0; k < 50; k++ {
+			pa, err := a.InsertString(rnd.Intn(a.Length()+1), "abc", sites[0])
+			Expect(err).NotTo(HaveOccurred())
+			pb, err := b.InsertString(rnd.Intn(b.Length()+1), "xyz", sites[1])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = pb.Apply(a.Document)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = pa.Apply(b.Document)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(a.String()).To(Equal(b.String()))
+		Expect(a.Length()).To(Equal(300))
+	})
+})
@@ -0,0 +1,189 @@
+package document
+
+import "github.com/mezis/lseq/position"
+
+// A node of a persistent AVL tree of atoms, ordered by position, with the
+// size of each subtree so that atoms can be found by index.
+//
+// Nodes are never changed once built: changes return a new root, copying the
+// O(log n) nodes on the path to the change and sharing all others with the
+// former tree; which lives on unchanged. The empty tree is nil.
+type node struct {
+	atom        *atom
+	left, right *node
+	size        int
+	height      int
+}
+
+// Return the number of atoms in the tree.
+func (n *node) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *node) depth() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func newNode(a *atom, left *node, right *node) *node {
+	return &node{
+		atom:   a,
+		left:   left,
+		right:  right,
+		size:   left.len() + right.len() + 1,
+		height: max(left.depth(), right.depth()) + 1,
+	}
+}
+
+// Return a tree of `a` between `left` and `right`, whose heights differ by at
+// most 2, rotating as needed to balance it.
+func balance(a *atom, left *node, right *node) *node {
+	switch {
+	case left.depth() > right.depth()+1:
+		if left.left.depth() >= left.right.depth() {
+			return newNode(left.atom, left.left, newNode(a, left.right, right))
+		}
+		return newNode(left.right.atom,
+			newNode(left.atom, left.left, left.right.left),
+			newNode(a, left.right.right, right))
+	case right.depth() > left.depth()+1:
+		if right.right.depth() >= right.left.depth() {
+			return newNode(right.atom, newNode(a, left, right.left), right.right)
+		}
+		return newNode(right.left.atom,
+			newNode(a, left, right.left.left),
+			newNode(right.atom, right.left.right, right.right))
+	}
+	return newNode(a, left, right)
+}
+
+// Return the tree with `a` inserted, or `n` itself if there is an atom at its
+// position already.
+func (n *node) insert(a *atom) *node {
+	if n == nil {
+		return newNode(a, nil, nil)
+	}
+	switch c := a.pos.Compare(n.atom.pos); {
+	case c < 0:
+		if left := n.left.insert(a); left != n.left {
+			return balance(n.atom, left, n.right)
+		}
+	case c > 0:
+		if right := n.right.insert(a); right != n.right {
+			return balance(n.atom, n.left, right)
+		}
+	}
+	return n
+}
+
+// Return the tree without the atom at `pos`, and that atom; or `n` itself and
+// nil if there is none.
+func (n *node) delete(pos *position.Position) (*node, *atom) {
+	if n == nil {
+		return nil, nil
+	}
+	switch c := pos.Compare(n.atom.pos); {
+	case c < 0:
+		left, a := n.left.delete(pos)
+		if a == nil {
+			return n, nil
+		}
+		return balance(n.atom, left, n.right), a
+	case c > 0:
+		right, a := n.right.delete(pos)
+		if a == nil {
+			return n, nil
+		}
+		return balance(n.atom, n.left, right), a
+	}
+	if n.right == nil {
+		return n.left, n.atom
+	}
+	right, next := n.right.deleteFirst()
+	return balance(next, n.left, right), n.atom
+}
+
+// Return the tree without its first atom, and that atom.
+func (n *node) deleteFirst() (*node, *atom) {
+	if n.left == nil {
+		return n.right, n.atom
+	}
+	left, a := n.left.deleteFirst()
+	return balance(n.atom, left, n.right), a
+}
+
+// Return the atom at `pos`, or nil.
+func (n *node) get(pos *position.Position) *atom {
+	for n != nil {
+		switch c := pos.Compare(n.atom.pos); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			n = n.right
+		default:
+			return n.atom
+		}
+	}
+	return nil
+}
+
+// Return the atom indexed `idx`.
+func (n *node) at(idx int) *atom {
+	for {
+		switch k := n.left.len(); {
+		case idx < k:
+			n = n.left
+		case idx > k:
+			idx -= k + 1
+			n = n.right
+		default:
+			return n.atom
+		}
+	}
+}
+
+// Return the index of the first atom at or after `pos`, and that atom; or
+// `len()` and nil if there is none.
+func (n *node) search(pos *position.Position) (int, *atom) {
+	idx, offset := n.len(), 0
+	var out *atom
+	for n != nil {
+		if pos.Compare(n.atom.pos) <= 0 {
+			idx, out = offset+n.left.len(), n.atom
+			n = n.left
+		} else {
+			offset += n.left.len() + 1
+			n = n.right
+		}
+	}
+	return idx, out
+}
+
+// Call `cb` with the atoms from the one indexed `from`, in order, while it
+// returns true.
+func (n *node) each(from int, cb func(*atom) bool) bool {
+	for n != nil {
+		k := n.left.len()
+		if from < k {
+			if !n.left.each(from, cb) {
+				return false
+			}
+			from = k
+		}
+		if from == k {
+			if !cb(n.atom) {
+				return false
+			}
+			from++
+		}
+		// tail call on the right subtree
+		from -= k + 1
+		n = n.right
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package document
+
+import (
+	"errors"
+
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+)
+
+// ErrEmptyHistory is returned by `UndoManager.Undo` and `UndoManager.Redo`
+// when there is nothing to undo or redo.
+var ErrEmptyHistory = errors.New("document: nothing to undo or redo")
+
+// UndoManager -
+// Applies patches to a document, keeping track of each site's patches so that
+// they can be undone and redone.
+//
+// Undoing a site's patch only reverts what that patch did, leaving concurrent
+// edits from other sites untouched: atoms it inserted are deleted, unless
+// deleted already; and atoms it deleted are inserted again, at fresh positions
+// that keep their order, as positions are never reused (see `Document.Delete`).
+// Redoing reverts the undo in the same way.
+//
+// Undo and redo patches are sent to other replicas, like any other. Not
+// thread-safe.
+type UndoManager struct {
+	doc     *Document
+	history map[uid.Uid]*history
+	// fresh positions of atoms inserted again, by their former positions; so
+	// that older patches still refer to them
+	moved map[string]*position.Position
+}
+
+// Undo and redo stacks of a site.
+type history struct {
+	undo, redo []*Patch
+}
+
+// NewUndoManager returns a manager applying patches to `doc`.
+func NewUndoManager(doc *Document) *UndoManager {
+	return &UndoManager{
+		doc:     doc,
+		history: make(map[uid.Uid]*history),
+		moved:   make(map[string]*position.Position),
+	}
+}
+
+// Apply -
+// Apply `p` to the document like `Patch.Apply`, pushing the items applied onto
+// the undo stack of the patch's site, and clearing its redo stack.
+func (m *UndoManager) Apply(p *Patch) (ApplyResult, error) {
+	res, err := p.Apply(m.doc)
+	if err != nil || res.Redelivered {
+		return res, err
+	}
+	h := m.historyOf(p.site)
+	h.undo = append(h.undo, NewPatchFromItems(p.site, res.Applied...))
+	h.redo = nil
+	return res, nil
+}
+
+// CanUndo returns true iff `site` has patches to undo.
+func (m *UndoManager) CanUndo(site uid.Uid) bool {
+	h := m.history[site]
+	return h != nil && len(h.undo) > 0
+}
+
+// CanRedo returns true iff `site` has undone patches to redo.
+func (m *UndoManager) CanRedo(site uid.Uid) bool {
+	h := m.history[site]
+	return h != nil && len(h.redo) > 0
+}
+
+// Undo -
+// Revert the last patch from `site` that was applied or redone, and return the
+// patch applied to do so, for other replicas.
+//
+// Returns `ErrEmptyHistory` if there is nothing to undo; and
+// `position.ErrExhausted`, changing nothing, if deleted atoms cannot be
+// inserted again.
+func (m *UndoManager) Undo(site uid.Uid) (*Patch, error) {
+	h := m.historyOf(site)
+	return m.step(&h.undo, &h.redo, site)
+}
+
+// Redo -
+// Revert the last undo from `site`, and return the patch applied to do so, for
+// other replicas. Returns the same errors as `Undo`.
+func (m *UndoManager) Redo(site uid.Uid) (*Patch, error) {
+	h := m.historyOf(site)
+	return m.step(&h.redo, &h.undo, site)
+}
+
+func (m *UndoManager) historyOf(site uid.Uid) *history {
+	h := m.history[site]
+	if h == nil {
+		h = new(history)
+		m.history[site] = h
+	}
+	return h
+}
+
+// Revert the patch on top of `from`, and move it to `to`.
+func (m *UndoManager) step(from *[]*Patch, to *[]*Patch, site uid.Uid) (*Patch, error) {
+	if len(*from) == 0 {
+		return nil, ErrEmptyHistory
+	}
+	p, err := m.revert((*from)[len(*from)-1], site)
+	if err != nil {
+		return nil, err
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, p)
+	return p, nil
+}
+
+// Apply, and return, a patch from `site` reverting `p` in the current
+// document.
+func (m *UndoManager) revert(p *Patch, site uid.Uid) (*Patch, error) {
+	inv := p.Invert()
+
+	// atoms both inserted and deleted by `p` cancel out
+	seen := make(map[string]int, len(inv.items))
+	for _, i := range inv.items {
+		seen[i.pos.String()]++
+	}
+
+	out := m.doc.newPatch(site)
+	inserts := []Item{}
+	for _, i := range inv.items {
+		if seen[i.pos.String()] > 1 {
+			continue
+		}
+		if i.op == OpInsert {
+			inserts = append(inserts, i)
+			continue
+		}
+		for {
+			next, ok := m.moved[i.pos.String()]
+			if !ok {
+				break
+			}
+			i.pos = next
+		}
+		if _, present, _ := m.doc.lookup(i.pos); present {
+			out.items = append(out.items, i)
+		}
+	}
+
+	// insert deleted atoms again, each right after its former position, so
+	// that they keep their order with all other atoms, including ones
+	// inserted again earlier
+	for _, i := range inserts {
+		pos, err := m.doc.allocateAfter(i.pos, site)
+		if err != nil {
+			return nil, err
+		}
+		out.Add(OpInsert, pos, i.data)
+	}
+
+	if len(out.items) > 0 {
+		if _, err := out.Apply(m.doc); err != nil {
+			return nil, err
+		}
+	}
+	// insertions follow deletions in `out`
+	for k, i := range inserts {
+		m.moved[i.pos.String()] = out.items[len(out.items)-len(inserts)+k].pos
+	}
+	return out, nil
+}
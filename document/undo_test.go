@@ -0,0 +1,185 @@
+package document_test
+
+import (
+	"fmt"
+	"math/rand"
+
+	. "github.com/mezis/lseq/document"
+	"github.com/mezis/lseq/position"
+	"github.com/mezis/lseq/uid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Undo", func() {
+	local, remote := uid.Uid(0xF00F00F0), uid.Uid(0xBA5EBA11)
+
+	Describe("Patch.Invert", func() {
+		It("reverses items and operations", func() {
+			doc := NewDocument()
+			pos, _ := doc.Allocate(0, 2, local)
+			p := NewPatchFromItems(local, NewItem(OpInsert, pos[0], "hello"), NewItem(OpDelete, pos[1], "world"))
+			q := p.Invert()
+			Expect(q.Site()).To(Equal(local))
+			Expect(q.Items()).To(Equal([]Item{NewItem(OpInsert, pos[1], "world"), NewItem(OpDelete, pos[0], "hello")}))
+			Expect(q.Invert().Items()).To(Equal(p.Items()))
+			Expect(q.ID()).NotTo(Equal(p.ID()))
+		})
+	})
+
+	Describe("UndoManager", func() {
+		var (
+			doc *Document
+			m   *UndoManager
+		)
+		BeforeEach(func() {
+			doc = NewDocument()
+			m = NewUndoManager(doc)
+		})
+
+		edit := func(site uid.Uid, data ...string) {
+			p, err := NewPatch(doc, site, data)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = m.Apply(p)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		undo := func(site uid.Uid) *Patch {
+			p, err := m.Undo(site)
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		}
+		redo := func(site uid.Uid) *Patch {
+			p, err := m.Redo(site)
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		}
+
+		It("has nothing to undo or redo at first", func() {
+			Expect(m.CanUndo(local)).To(BeFalse())
+			Expect(m.CanRedo(local)).To(BeFalse())
+			_, err := m.Undo(local)
+			Expect(err).To(MatchError(ErrEmptyHistory))
+			_, err = m.Redo(local)
+			Expect(err).To(MatchError(ErrEmptyHistory))
+		})
+
+		It("undoes and redoes insertions", func() {
+			edit(local, "hello", "world")
+			undo(local)
+			Expect(doc.Data()).To(BeEmpty())
+			Expect(m.CanRedo(local)).To(BeTrue())
+			redo(local)
+			Expect(doc.Data()).To(Equal([]string{"hello", "world"}))
+		})
+
+		It("undoes deletions at fresh positions, in order", func() {
+			edit(local, "a", "b", "c", "d", "e")
+			before, _ := doc.At(1)
+			edit(local, "a", "e")
+			undo(local)
+			Expect(doc.Data()).To(Equal([]string{"a", "b", "c", "d", "e"}))
+			after, _ := doc.At(1)
+			Expect(after.Compare(before)).NotTo(Equal(0))
+		})
+
+		It("undoes and redoes several patches in turn", func() {
+			states := [][]string{
+				{"hello", "world"},
+				{"hello", "beautiful", "world"},
+				{"hello", "frabjous", "world", "!"},
+			}
+			for _, s := range states {
+				edit(local, s...)
+			}
+			for k := len(states) - 2; k >= 0; k-- {
+				undo(local)
+				Expect(doc.Data()).To(Equal(states[k]))
+			}
+			for k := 1; k < len(states); k++ {
+				redo(local)
+				Expect(doc.Data()).To(Equal(states[k]))
+			}
+		})
+
+		It("undoes and redoes random edits", func() {
+			for seed := int64(0); seed < 20; seed++ {
+				rnd := rand.New(rand.NewSource(seed))
+				doc = NewDocument(WithAllocator(position.WithSeed(seed)))
+				m = NewUndoManager(doc)
+				states := [][]string{doc.Data()}
+				for k := 0; k < 30; k++ {
+					data := doc.Data()
+					next := []string{}
+					if len(data) > 0 && rnd.Intn(3) == 0 {
+						idx := rnd.Intn(len(data))
+						next = append(next, data[:idx]...)
+						next = append(next, data[idx+1:]...)
+					} else {
+						idx := rnd.Intn(len(data) + 1)
+						next = append(next, data[:idx]...)
+						next = append(next, fmt.Sprintf("edit %d", k))
+						next = append(next, data[idx:]...)
+					}
+					edit(local, next...)
+					states = append(states, doc.Data())
+				}
+				for k := len(states) - 2; k >= 0; k-- {
+					undo(local)
+					Expect(doc.Data()).To(Equal(states[k]))
+				}
+				for k := 1; k < len(states); k++ {
+					redo(local)
+					Expect(doc.Data()).To(Equal(states[k]))
+				}
+			}
+		})
+
+		It("forgets undone patches on new edits", func() {
+			edit(local, "hello")
+			undo(local)
+			edit(local, "world")
+			Expect(m.CanRedo(local)).To(BeFalse())
+		})
+
+		It("leaves concurrent remote edits untouched", func() {
+			edit(local, "a", "b", "c")
+			edit(remote, "a", "b", "x", "c")
+			edit(local, "b", "x")
+			undo(local)
+			Expect(doc.Data()).To(Equal([]string{"a", "b", "x", "c"}))
+			undo(local)
+			Expect(doc.Data()).To(Equal([]string{"x"}))
+			Expect(m.CanUndo(remote)).To(BeTrue())
+		})
+
+		It("skips atoms deleted concurrently", func() {
+			edit(local, "hello", "world")
+			edit(remote, "world")
+			p := undo(local)
+			Expect(p.Length()).To(Equal(1))
+			Expect(doc.Data()).To(BeEmpty())
+		})
+
+		It("makes replicas converge", func() {
+			replica := NewDocument()
+			send := func(p *Patch) {
+				_, err := p.Apply(replica)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			p, _ := NewPatch(doc, local, []string{"hello", "beautiful", "world"})
+			m.Apply(p)
+			send(p)
+			p, _ = NewPatch(doc, local, []string{"hello", "world"})
+			m.Apply(p)
+			send(p)
+			send(undo(local))
+			Expect(replica.Data()).To(Equal([]string{"hello", "beautiful", "world"}))
+			send(redo(local))
+			Expect(replica.Data()).To(Equal([]string{"hello", "world"}))
+			send(undo(local))
+			Expect(replica.Data()).To(Equal(doc.Data()))
+		})
+	})
+})
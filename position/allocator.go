@@ -1,148 +1,281 @@
 package position
 
 import (
+	"errors"
 	"fmt"
-	"math/big"
+	"math/bits"
 	"math/rand"
 
 	"github.com/mezis/lseq/uid"
 )
 
+// ErrExhausted is returned when there is no room left to allocate a position
+// between two others, within the maximum number of digits of their shape.
+var ErrExhausted = errors.New("position: no room left between positions")
+
 // Allocator -
 // Used to allocate positions. Not thread-safe.
 type Allocator struct {
 	// allocator state
-	m StrategyMap
+	shape    TreeShape
+	strategy Strategy
+	rnd      *rand.Rand
 	// temporary variables used during allocations, set as state to minimise
 	// memory allocations and garbage collection.
-	n, p, q big.Int
-	lt, rt  Position
+	digits [maxDepth]uint32
+}
+
+// Option -
+// Configures an `Allocator` built by `NewAllocator`.
+type Option func(*Allocator)
+
+// WithShape -
+// Allocate positions in a tree of shape `s` instead of the `DefaultShape`.
+// Unless configured `WithStrategy`, the `LSEQ` strategy then uses the shape's
+// boundary.
+//
+// Panics if `s` is not valid; see `TreeShape.Validate`.
+func WithShape(s TreeShape) Option {
+	if err := s.Validate(); err != nil {
+		panic(err)
+	}
+	return func(alloc *Allocator) {
+		alloc.shape = s
+	}
+}
+
+// WithStrategy -
+// Allocate positions with `s` instead of the default `LSEQ` strategy.
+func WithStrategy(s Strategy) Option {
+	return func(alloc *Allocator) {
+		alloc.strategy = s
+	}
+}
+
+// WithSource -
+// Draw random numbers from `src` rather than from a randomly seeded source.
+// Allocators with equally seeded sources, strategies, and calls, allocate the
+// same positions; which makes tests and simulations reproducible.
+func WithSource(src rand.Source) Option {
+	return func(alloc *Allocator) {
+		alloc.rnd = rand.New(src)
+	}
+}
+
+// WithSeed -
+// Shorthand for `WithSource(rand.NewSource(seed))`.
+func WithSeed(seed int64) Option {
+	return WithSource(rand.NewSource(seed))
 }
 
 // NewAllocator -
 // Suitable to allocate a position between two others.
-func NewAllocator() *Allocator {
+func NewAllocator(opts ...Option) *Allocator {
 	out := new(Allocator)
-	out.n.SetUint64(0)
+	out.shape = defaultShape
+	out.rnd = rand.New(rand.NewSource(rand.Int63()))
+	for _, opt := range opts {
+		opt(out)
+	}
+	if out.strategy == nil {
+		out.strategy = &LSEQ{Boundary: out.shape.Boundary}
+	}
 	return out
 }
 
-// How many bits to left-shift `digits` by, if currently of length `a`,
-// to be length `b` ?
-//
-// TODO: this could be computed as a difference of cum-sums of bit counts, to
-// avoid the loop.
-func (*Allocator) shiftBits(a uint8, b uint8) uint {
-	out := uint(0)
-	for l := a; l < b; l++ {
-		out += uint(bitsAtDepth(l))
-	}
-	return out
+// Shape -
+// Return the shape of the tree positions are allocated in.
+func (alloc *Allocator) Shape() TreeShape {
+	return alloc.shape
 }
 
-// Set `pos` to be a prefix of `oth` of length `length`, paddding with
-// zeroes or trimming as appropriate.
+// Strategy -
+// Return the allocation strategy in use.
+func (alloc *Allocator) Strategy() Strategy {
+	return alloc.strategy
+}
+
+// Uint64 -
+// Return a random number from the allocator's source; eg. for identifiers of
+// what positions are allocated for, so that they are reproducible along with
+// the positions when the source is seeded.
+func (alloc *Allocator) Uint64() uint64 {
+	return alloc.rnd.Uint64()
+}
+
+// Set `digits` to the digits of `pos`, padding with zeroes or trimming as
+// appropriate.
 // Site identifiers are ignored.
-func (alloc *Allocator) setPrefix(pos *Position, oth *Position, length uint8) {
-	if oth.length > length { // trim
-		pos.digits.Rsh(&oth.digits, alloc.shiftBits(length, oth.length))
-	} else if oth.length < length { // pad
-		pos.digits.Lsh(&oth.digits, alloc.shiftBits(oth.length, length))
-	} else { // copy
-		pos.digits.Set(&oth.digits)
-	}
-	pos.length = length
+func setPrefix(digits []uint32, pos *Position) {
+	for d := range digits {
+		digits[d] = uint32(pos.DigitAt(uint8(d)))
+	}
+}
+
+// Add `n` to the variable-base number `digits`, whose bases are those of
+// `shape`, carrying into more significant digits.
+func addDigits(shape *TreeShape, digits []uint32, n uint64) {
+	for d := len(digits) - 1; d >= 0 && n > 0; d-- {
+		bits := shape.bitsAt(uint8(d))
+		sum := uint64(digits[d]) + n
+		digits[d] = uint32(sum & uint64(shape.maxDigitAt(uint8(d))))
+		n = sum >> bits
+	}
 }
 
 // Call -
 // Implementation of the core LSEQ allocation algorithm. Sets `out` to a new position between the
 // `left` and `right` ones, with `site` as a site identifier for new digits.
-func (alloc *Allocator) Call(out *Position, left *Position, right *Position, site uid.Uid) {
-	//fmt.Printf("Allocator.Call(\n\t%#v,\n\t%#v)\n", left, right)
-	if debug && !left.IsBefore(right) {
-		panic(fmt.Sprint("arguments not in order ", left, right))
+//
+// The storage of `out` is reused. Returns `ErrExhausted`, leaving `out`
+// untouched, if no position of at most the shape's maximum number of digits
+// fits; and `ErrShapeMismatch` if `left` or `right` are of another shape than
+// the allocator's.
+func (alloc *Allocator) Call(out *Position, left *Position, right *Position, site uid.Uid) error {
+	depth, interval, tie, err := alloc.findInterval(left, right, 1)
+	if err != nil {
+		return err
 	}
 
-	// find a depth and prefixes with a sufficient interval
-	//fmt.Printf("** finding prefixes\n")
-	var interval int
-	var depth uint8
-	for depth = 1; depth < maxDigits; depth++ {
-		//fmt.Printf("*** depth %d\n", depth)
-		alloc.setPrefix(&alloc.lt, left, depth)
-		alloc.setPrefix(&alloc.rt, right, depth)
-		interval = alloc.rt.Interval(&alloc.lt)
-		//fmt.Printf("  left  = %#v\n", &alloc.lt)
-		//fmt.Printf("  right = %#v\n", &alloc.rt)
-		//fmt.Printf("  interval(%d) = %d\n", depth, interval)
-		if interval >= 1 {
-			break
-		}
+	// calculate digits for the new position
+	offset := alloc.strategy.Offset(uint8(depth-1), int(interval), alloc.rnd)
+	if offset < 1 || int64(offset) > interval {
+		panic(fmt.Sprintf("strategy %#v picked offset %d out of [1, %d]", alloc.strategy, offset, interval))
+	}
+	alloc.setDigits(out, left, right, tie, depth, uint64(offset), site)
+
+	// check and return
+	if debug && !(left.IsBefore(out) && out.IsBefore(right)) {
+		panic("allocated position not in order")
 	}
-	if debug && depth >= maxDigits {
-		panic("max depth reached")
+	return nil
+}
+
+// CallN -
+// Bulk variant of `Call`. Sets the positions in `out` to `len(out)` ordered
+// positions between the `left` and `right` ones, in a single pass.
+//
+// Rather than allocating each position after the previous one, which makes
+// positions grow deeper as `out` grows, finds the shallowest depth with room for
+// all of them and spreads them evenly at that depth; which suits pasting many
+// atoms at once. A single position is allocated as by `Call`, following the
+// strategy.
+//
+// The storage of the positions in `out` is reused. Returns the same errors as
+// `Call`, leaving `out` untouched.
+func (alloc *Allocator) CallN(out []*Position, left *Position, right *Position, site uid.Uid) error {
+	if len(out) <= 1 {
+		if len(out) == 0 {
+			return nil
+		}
+		return alloc.Call(out[0], left, right, site)
 	}
-	if debug && interval < 1 {
-		panic("failed to locate big enough interval")
+
+	n := uint64(len(out))
+	depth, interval, tie, err := alloc.findInterval(left, right, int64(n))
+	if err != nil {
+		return err
 	}
 
-	// calculate digits for the new position
-	//fmt.Println("** calculate digits")
-	//fmt.Println("*** interval:", interval)
-	offset := rand.Intn(min(boundary, interval)) + 1
-
-	out.length = depth
-	out.sites.SetInt64(int64(0))
-
-	alloc.n.SetInt64(int64(offset))
-	s := alloc.m.Get(depth)
-	switch s {
-	case boundaryLoStrategy:
-		out.digits.Add(&alloc.lt.digits, &alloc.n)
-	case boundaryHiStrategy:
-		out.digits.Sub(&alloc.rt.digits, &alloc.n)
-	default:
-		panic(fmt.Sprintf("unknown strategy %#v", s))
-	}
-	//fmt.Printf("*** strategy[%d]: %s\n", depth, s)
-	//fmt.Println("*** offset:", &alloc.n)
-	//fmt.Println("*** result:", out)
+	// the k-th position is at `(k+1)/(n+1)` of the interval; as the interval
+	// has at least `n` free identifiers, offsets are distinct, and between 1
+	// and `interval`.
+	for k, pos := range out {
+		hi, lo := bits.Mul64(uint64(k+1), uint64(interval+1))
+		offset, _ := bits.Div64(hi, lo, n+1)
+		alloc.setDigits(pos, left, right, tie, depth, offset, site)
+	}
 
-	// merge site identifiers
-	//fmt.Println("** interleave new indentifiers")
-	for d := uint8(0); d < out.length; d++ {
-		// read digits
-		out.digitAt(&alloc.n, d)
-		left.digitAt(&alloc.p, d)
-		right.digitAt(&alloc.q, d)
-
-		// shift and set digit
-		out.sites.Lsh(&out.sites, uint(bitsAtDepth(d)))
-		out.sites.Or(&out.sites, &alloc.n)
-
-		if bigEql(&alloc.n, &alloc.p) { // use left site
-			left.siteAt(&alloc.n, d)
-		} else if bigEql(&alloc.n, &alloc.q) { // use right site
-			right.siteAt(&alloc.n, d)
-		} else { // use caller site
-			site.ToBig(&alloc.n)
+	if debug {
+		prev := left
+		for _, pos := range out {
+			if !prev.IsBefore(pos) {
+				panic("allocated positions not in order")
+			}
+			prev = pos
+		}
+		if !prev.IsBefore(right) {
+			panic("allocated positions not in order")
 		}
+	}
+	return nil
+}
+
+// Return the shallowest `depth` at which prefixes of `left` and `right` have
+// at least `need` free identifiers between them, and how many (`interval`).
+//
+// When `left` and `right` first differ by their sites only, `tie` is that
+// depth, and -1 otherwise.
+func (alloc *Allocator) findInterval(left *Position, right *Position, need int64) (depth int, interval int64, tie int, err error) {
+	shape := &alloc.shape
+	if !shape.Compatible(*left.layout()) || !shape.Compatible(*right.layout()) {
+		return 0, 0, 0, ErrShapeMismatch
+	}
+	if debug && !left.IsBefore(right) {
+		panic(fmt.Sprint("arguments not in order ", left, right))
+	}
+	maxDigits := int(shape.MaxDigits)
 
-		// shift and set site
-		out.sites.Lsh(&out.sites, uid.Bits)
-		out.sites.Or(&out.sites, &alloc.n)
+	// When `left` and `right` first differ by their sites only, any extension
+	// of `left` past that depth sorts before `right`; so treat `right` as
+	// having the next digit at the following depth.
+	tie = -1
+	for d := 0; d < maxDigits; d++ {
+		l, r := left.identAt(d), right.identAt(d)
+		if l != r {
+			if l.digit == r.digit {
+				tie = d
+			}
+			break
+		}
+	}
+	rightDigit := func(d uint8) int64 {
+		switch {
+		case tie < 0 || int(d) <= tie:
+			return int64(right.DigitAt(d))
+		case int(d) == tie+1:
+			return 1 << shape.bitsAt(d)
+		default:
+			return 0
+		}
 	}
 
-	// check and return
-	if debug && !(left.IsBefore(out) && out.IsBefore(right)) {
-		//fmt.Printf("left = %#v\n", left)
-		//fmt.Printf("out = %#v\n", out)
-		//fmt.Printf("right = %#v\n", right)
-		panic("allocated position not in order")
+	// find a depth and prefixes with a sufficient interval
+	delta := int64(0)
+	for depth = 1; depth <= maxDigits; depth++ {
+		d := uint8(depth - 1)
+		delta = widen(delta, shape.bitsAt(d), rightDigit(d)-int64(left.DigitAt(d)))
+		if delta-1 >= need {
+			return depth, delta - 1, tie, nil
+		}
 	}
-	//fmt.Println("** returning ", out)
+	return 0, 0, 0, ErrExhausted
 }
 
-func bigEql(a *big.Int, b *big.Int) bool {
-	return a.Cmp(b) == 0
+// Set `out` to the `depth` first digits of `left`, plus `offset`; with sites
+// from `left` or `right` for digits they share, and `site` for others. `tie`
+// is as returned by `findInterval`.
+//
+// Past the length of `left` or `right`, their digits are padding, whose site
+// is not taken; so that `out` does not end with padding, and equal a prefix of
+// itself. Up to `tie`, `out` is padded as `left` is, to sort before `right`.
+func (alloc *Allocator) setDigits(out *Position, left *Position, right *Position, tie int, depth int, offset uint64, site uid.Uid) {
+	// the new digits are `left`'s prefix, plus `offset`
+	digits := alloc.digits[:depth]
+	setPrefix(digits, left)
+	addDigits(&alloc.shape, digits, offset)
+
+	// merge site identifiers
+	ids := out.ids[:0]
+	for d, digit := range digits {
+		id := ident{digit: digit, site: site}
+		if (d < left.Length() || d <= tie) && int(digit) == left.DigitAt(uint8(d)) { // use left site
+			id.site = left.SiteAt(uint8(d))
+		} else if (tie < 0 || d <= tie) && d < right.Length() && int(digit) == right.DigitAt(uint8(d)) { // use right site
+			id.site = right.SiteAt(uint8(d))
+		}
+		ids = append(ids, id)
+	}
+	out.ids = ids
+	out.shape = left.shape
 }
@@ -2,6 +2,7 @@ package position_test
 
 import (
 	"fmt"
+	"math/rand"
 	"runtime"
 	"testing"
 
@@ -20,7 +21,7 @@ var _ = Describe("Allocator", func() {
 			q := new(Position)
 			a := NewAllocator()
 
-			a.Call(q, p1, p2, 0xF00F00F0)
+			Expect(a.Call(q, p1, p2, 0xF00F00F0)).To(Succeed())
 
 			Expect(q.String()).To(Equal("<21 @DEADBEEF, 43 @F00F00F0>"))
 		})
@@ -31,7 +32,7 @@ var _ = Describe("Allocator", func() {
 			q := new(Position)
 			a := NewAllocator()
 
-			a.Call(q, p1, p2, 0xF00F00F0)
+			Expect(a.Call(q, p1, p2, 0xF00F00F0)).To(Succeed())
 
 			// fmt.Printf("pObs = %#v\n", pObs)
 			Expect(q.DigitAt(0)).To(Equal(16))
@@ -39,6 +40,160 @@ var _ = Describe("Allocator", func() {
 			Expect(q.Length()).To(Equal(3))
 			Expect(q.SiteAt(2)).To(Equal(uid.Uid(0xF00F00F0)))
 		})
+
+		It("inserts between positions differing only by site", func() {
+			p1 := new(Position).Append(16, 0xA).Append(63, 0xA)
+			p2 := new(Position).Append(16, 0xB)
+			q := new(Position)
+			a := NewAllocator()
+
+			for k := 0; k < 100; k++ {
+				Expect(a.Call(q, p1, p2, 0xF00F00F0)).To(Succeed())
+				Expect(p1.IsBefore(q)).To(BeTrue())
+				Expect(q.IsBefore(p2)).To(BeTrue())
+			}
+		})
+
+		It("reports exhaustion between adjacent positions of maximum length", func() {
+			digits := make([]uint, 26)
+			p1 := makePosition(digits...)
+			digits[25] = 1
+			p2 := makePosition(digits...)
+			q := makePosition(21)
+			a := NewAllocator()
+
+			Expect(a.Call(q, p1, p2, 0xF00F00F0)).To(MatchError(ErrExhausted))
+			Expect(q.String()).To(Equal("<21 @DEADBEEF>"))
+		})
+	})
+
+	Describe("CallN", func() {
+		newPositions := func(n int) []*Position {
+			out := make([]*Position, n)
+			for k := range out {
+				out[k] = new(Position)
+			}
+			return out
+		}
+
+		checkOrdered := func(l []*Position, left *Position, right *Position) {
+			prev := left
+			for _, q := range l {
+				Expect(prev.IsBefore(q)).To(BeTrue(), "%v < %v", prev, q)
+				prev = q
+			}
+			Expect(prev.IsBefore(right)).To(BeTrue())
+		}
+
+		It("allocates ordered positions", func() {
+			for _, n := range []int{0, 1, 2, 10, 31, 1000} {
+				l := newPositions(n)
+				Expect(NewAllocator().CallN(l, SentinelHead, SentinelTail, 0xF00F00F0)).To(Succeed())
+				checkOrdered(l, SentinelHead, SentinelTail)
+			}
+		})
+
+		It("allocates at the shallowest depth with enough room", func() {
+			p1 := makePosition(16, 30)
+			p2 := makePosition(16, 31)
+			l := newPositions(10000)
+			Expect(NewAllocator().CallN(l, p1, p2, 0xF00F00F0)).To(Succeed())
+			checkOrdered(l, p1, p2)
+			for _, q := range l {
+				// 7 bits at depth 2, 8 at depth 3: 32768 free identifiers
+				Expect(q.Length()).To(Equal(4))
+			}
+		})
+
+		It("spreads positions evenly", func() {
+			p1 := makePosition(16, 0)
+			p2 := makePosition(16, 40)
+			l := newPositions(3)
+			Expect(NewAllocator().CallN(l, p1, p2, 0xF00F00F0)).To(Succeed())
+			Expect(l[0].String()).To(Equal("<16 @DEADBEEF, 10 @F00F00F0>"))
+			Expect(l[1].String()).To(Equal("<16 @DEADBEEF, 20 @F00F00F0>"))
+			Expect(l[2].String()).To(Equal("<16 @DEADBEEF, 30 @F00F00F0>"))
+		})
+
+		It("allocates between positions differing only by site", func() {
+			p1 := new(Position).Append(16, 0xA).Append(63, 0xA)
+			p2 := new(Position).Append(16, 0xB)
+			l := newPositions(100)
+			Expect(NewAllocator().CallN(l, p1, p2, 0xF00F00F0)).To(Succeed())
+			checkOrdered(l, p1, p2)
+		})
+
+		It("uses its site for digits past the ends' length", func() {
+			p1 := new(Position).Append(1, 0xA)
+			p2 := new(Position).Append(3, 0xB)
+			l := newPositions(100)
+			Expect(NewAllocator().CallN(l, p1, p2, 0xF00F00F0)).To(Succeed())
+			checkOrdered(l, p1, p2)
+			for _, q := range l {
+				for d := 1; d < q.Length(); d++ {
+					Expect(q.SiteAt(uint8(d))).To(Equal(uid.Uid(0xF00F00F0)), "%v", q)
+				}
+				prefix := new(Position).Append(uint(q.DigitAt(0)), q.SiteAt(0))
+				Expect(q.Compare(prefix)).NotTo(Equal(0), "%v", q)
+			}
+		})
+
+		It("reports exhaustion", func() {
+			digits := make([]uint, 26)
+			p1 := makePosition(digits...)
+			digits[25] = 3
+			p2 := makePosition(digits...)
+			l := newPositions(3)
+			Expect(NewAllocator().CallN(l[:2], p1, p2, 0xF00F00F0)).To(Succeed())
+			Expect(NewAllocator().CallN(l, p1, p2, 0xF00F00F0)).To(MatchError(ErrExhausted))
+		})
+	})
+})
+
+var _ = Describe("NewAllocator", func() {
+	allocate := func(a *Allocator) []string {
+		out := []string{}
+		left, right := SentinelHead, SentinelTail
+		for k := 0; k < 100; k++ {
+			q := new(Position)
+			Expect(a.Call(q, left, right, 0xF00F00F0)).To(Succeed())
+			out = append(out, q.String())
+			left = q
+		}
+		return out
+	}
+
+	It("allocates reproducibly with a seed", func() {
+		Expect(allocate(NewAllocator(WithSeed(42)))).To(Equal(allocate(NewAllocator(WithSeed(42)))))
+	})
+
+	It("allocates reproducibly with a source", func() {
+		a1 := NewAllocator(WithSource(rand.NewSource(42)))
+		a2 := NewAllocator(WithSource(rand.NewSource(42)))
+		Expect(allocate(a1)).To(Equal(allocate(a2)))
+	})
+
+	It("allocates differently with different seeds", func() {
+		Expect(allocate(NewAllocator(WithSeed(1)))).NotTo(Equal(allocate(NewAllocator(WithSeed(2)))))
+	})
+
+	It("draws random numbers reproducibly with a seed", func() {
+		a1, a2 := NewAllocator(WithSeed(42)), NewAllocator(WithSeed(42))
+		Expect(a1.Uint64()).To(Equal(a2.Uint64()))
+		Expect(a1.Uint64()).NotTo(Equal(NewAllocator(WithSeed(7)).Uint64()))
+	})
+
+	It("allocates reproducibly after restoring its strategy map", func() {
+		a1 := NewAllocator(WithSeed(42))
+		allocate(a1)
+		buf, err := a1.Strategy().(*LSEQ).Map.MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+
+		s := new(LSEQ)
+		Expect(s.Map.UnmarshalBinary(buf)).To(Succeed())
+		a2 := NewAllocator(WithSeed(7), WithStrategy(s))
+		a1 = NewAllocator(WithSeed(7), WithStrategy(a1.Strategy()))
+		Expect(allocate(a1)).To(Equal(allocate(a2)))
 	})
 })
 
@@ -75,3 +230,45 @@ func BenchmarkPositionAllocate(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkAllocatorPaste(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		l := make([]*Position, n)
+		for k := range l {
+			l[k] = new(Position)
+		}
+		// paste between two atoms with little room between them, as in a
+		// document that was edited before
+		left := makePosition(16, 30)
+		right := makePosition(16, 32)
+
+		b.Run(fmt.Sprintf("mode=call/count=%d", n), func(b *testing.B) {
+			alloc := NewAllocator(WithSeed(1))
+			digits := 0
+			for k := 0; k < b.N; k++ {
+				prev := left
+				for _, q := range l {
+					if err := alloc.Call(q, prev, right, 0xF00F00F0); err != nil {
+						b.Fatal(err)
+					}
+					prev = q
+					digits += q.Length()
+				}
+			}
+			b.ReportMetric(float64(digits)/float64(b.N*n), "digits/pos")
+		})
+		b.Run(fmt.Sprintf("mode=callN/count=%d", n), func(b *testing.B) {
+			alloc := NewAllocator(WithSeed(1))
+			digits := 0
+			for k := 0; k < b.N; k++ {
+				if err := alloc.CallN(l, left, right, 0xF00F00F0); err != nil {
+					b.Fatal(err)
+				}
+				for _, q := range l {
+					digits += q.Length()
+				}
+			}
+			b.ReportMetric(float64(digits)/float64(b.N*n), "digits/pos")
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package position
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mezis/lseq/uid"
+)
+
+// Version of the binary encoding produced by `MarshalBinary`.
+//
+// Layout:
+//
+//	version  byte
+//	shape    3 bytes, root bits, growth, and maximum digits
+//	length   uvarint, number of digits
+//	digits   uvarint, once per digit, bounded by the shape
+//	sites    runs of (uvarint count, 8-byte big-endian site) covering all digits
+const encodingVersion = 1
+
+// ErrTruncated is returned when decoding input that ends prematurely.
+var ErrTruncated = errors.New("position: truncated input")
+
+// ErrMalformed is returned when decoding input that is structurally invalid
+// (bad site runs, trailing bytes).
+var ErrMalformed = errors.New("position: malformed input")
+
+// VersionError is returned when decoding input written in an unknown
+// encoding version.
+type VersionError uint8
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("position: unknown encoding version %d", uint8(e))
+}
+
+// LengthError is returned when a position has more digits than its shape
+// allows.
+type LengthError uint64
+
+func (e LengthError) Error() string {
+	return fmt.Sprintf("position: length %d exceeds maximum", uint64(e))
+}
+
+// DigitError is returned when a digit does not fit the base at its depth.
+type DigitError struct {
+	Depth uint8
+	Digit uint64
+}
+
+func (e *DigitError) Error() string {
+	return fmt.Sprintf("position: digit %d at depth %d exceeds maximum", e.Digit, e.Depth)
+}
+
+// MarshalBinary --
+// Implement `encoding.BinaryMarshaler`.
+func (pos *Position) MarshalBinary() ([]byte, error) {
+	return pos.MarshalBinaryVersion(encodingVersion)
+}
+
+// MarshalBinaryVersion -
+// Like `MarshalBinary`, but in encoding `version` rather than the latest one;
+// eg. for encodings embedding positions, or hashes of positions, that must not
+// change when a later version is introduced.
+//
+// Returns a `VersionError` for unknown versions.
+func (pos *Position) MarshalBinaryVersion(version uint8) ([]byte, error) {
+	if version != encodingVersion {
+		return nil, VersionError(version)
+	}
+	length := len(pos.ids)
+	shape := pos.layout()
+	out := make([]byte, 0, 5+3*length+9)
+	out = append(out, version, shape.RootBits, shape.Growth, shape.MaxDigits)
+	out = binary.AppendUvarint(out, uint64(length))
+	for _, id := range pos.ids {
+		out = binary.AppendUvarint(out, uint64(id.digit))
+	}
+
+	// write each site once per run of equal sites
+	for d := 0; d < length; {
+		site := pos.ids[d].site
+		run := 1
+		for d+run < length && pos.ids[d+run].site == site {
+			run++
+		}
+		out = binary.AppendUvarint(out, uint64(run))
+		out = binary.BigEndian.AppendUint64(out, uint64(site))
+		d += run
+	}
+	return out, nil
+}
+
+// UnmarshalBinary --
+// Implement `encoding.BinaryUnmarshaler`.
+func (pos *Position) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+	if data[0] != encodingVersion {
+		return VersionError(data[0])
+	}
+	if len(data) < 4 {
+		return ErrTruncated
+	}
+	shape := TreeShape{RootBits: data[1], Growth: data[2], MaxDigits: data[3]}
+	if err := shape.Validate(); err != nil {
+		return err
+	}
+	data = data[4:]
+
+	length, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	if length > uint64(shape.MaxDigits) {
+		return LengthError(length)
+	}
+
+	ids := make([]ident, length)
+	for d := range ids {
+		var digit uint64
+		digit, data, err = readUvarint(data)
+		if err != nil {
+			return err
+		}
+		if digit > uint64(shape.maxDigitAt(uint8(d))) {
+			return &DigitError{Depth: uint8(d), Digit: digit}
+		}
+		ids[d].digit = uint32(digit)
+	}
+
+	for d := uint64(0); d < length; {
+		var run uint64
+		run, data, err = readUvarint(data)
+		if err != nil {
+			return err
+		}
+		if run == 0 || run > length-d {
+			return ErrMalformed
+		}
+		if len(data) < 8 {
+			return ErrTruncated
+		}
+		site := uid.Uid(binary.BigEndian.Uint64(data))
+		data = data[8:]
+		for ; run > 0; run-- {
+			ids[d].site = site
+			d++
+		}
+	}
+	if len(data) > 0 {
+		return ErrMalformed
+	}
+
+	pos.ids = ids
+	pos.shape = shape.ref()
+	return nil
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	val, n := binary.Uvarint(data)
+	if n == 0 {
+		return 0, data, ErrTruncated
+	}
+	if n < 0 {
+		return 0, data, ErrMalformed
+	}
+	return val, data[n:], nil
+}
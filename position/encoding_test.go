@@ -0,0 +1,105 @@
+package position_test
+
+import (
+	. "github.com/mezis/lseq/position"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Position encoding", func() {
+	roundTrip := func(p *Position) *Position {
+		buf, err := p.MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+		q := new(Position)
+		Expect(q.UnmarshalBinary(buf)).To(Succeed())
+		return q
+	}
+
+	Describe("MarshalBinary", func() {
+		It("round-trips the empty position", func() {
+			q := roundTrip(new(Position))
+			Expect(q.Length()).To(Equal(0))
+		})
+
+		It("round-trips the sentinels", func() {
+			Expect(roundTrip(SentinelHead).Compare(SentinelHead)).To(Equal(0))
+			Expect(roundTrip(SentinelTail).Compare(SentinelTail)).To(Equal(0))
+		})
+
+		It("round-trips positions with mixed sites", func() {
+			p := makePosition(21, 42).Append(3, 0xF00F00F0).Append(200, 0xF00F00F0)
+			q := roundTrip(p)
+			Expect(q.String()).To(Equal(p.String()))
+			Expect(q.Compare(p)).To(Equal(0))
+		})
+
+		It("round-trips random positions", func() {
+			for k := 0; k < 1000; k++ {
+				p := genPosition(uint(k%24 + 1))
+				Expect(roundTrip(p).String()).To(Equal(p.String()))
+			}
+		})
+
+		It("writes runs of equal sites once", func() {
+			short, _ := makePosition(1).MarshalBinary()
+			long, _ := makePosition(1, 1, 1, 1).MarshalBinary()
+			// three more single-byte digits, and no more sites
+			Expect(len(long) - len(short)).To(Equal(3))
+		})
+	})
+
+	Describe("MarshalBinaryVersion", func() {
+		It("writes the latest version like MarshalBinary", func() {
+			p := makePosition(21, 42)
+			buf, _ := p.MarshalBinary()
+			Expect(p.MarshalBinaryVersion(buf[0])).To(Equal(buf))
+		})
+
+		It("rejects unknown versions", func() {
+			_, err := makePosition(21).MarshalBinaryVersion(42)
+			Expect(err).To(Equal(VersionError(42)))
+		})
+	})
+
+	Describe("UnmarshalBinary", func() {
+		It("rejects empty input", func() {
+			Expect(new(Position).UnmarshalBinary(nil)).To(MatchError(ErrTruncated))
+		})
+
+		It("rejects unknown versions", func() {
+			err := new(Position).UnmarshalBinary([]byte{42, 0})
+			Expect(err).To(Equal(VersionError(42)))
+		})
+
+		It("rejects excessive lengths", func() {
+			err := new(Position).UnmarshalBinary([]byte{1, 5, 1, 26, 27})
+			Expect(err).To(Equal(LengthError(27)))
+		})
+
+		It("rejects oversized digits", func() {
+			err := new(Position).UnmarshalBinary([]byte{1, 5, 1, 26, 1, 32, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+			Expect(err).To(BeAssignableToTypeOf(&DigitError{}))
+			Expect(err.(*DigitError).Depth).To(Equal(uint8(0)))
+			Expect(err.(*DigitError).Digit).To(Equal(uint64(32)))
+		})
+
+		It("rejects truncated input", func() {
+			buf, _ := makePosition(21, 42).MarshalBinary()
+			for n := 1; n < len(buf); n++ {
+				Expect(new(Position).UnmarshalBinary(buf[:n])).To(MatchError(ErrTruncated))
+			}
+		})
+
+		It("rejects site runs not covering all digits", func() {
+			err := new(Position).UnmarshalBinary([]byte{1, 5, 1, 26, 1, 3, 2, 0, 0, 0, 0, 0, 0, 0, 0})
+			Expect(err).To(MatchError(ErrMalformed))
+		})
+
+		It("rejects trailing bytes", func() {
+			buf, _ := makePosition(21, 42).MarshalBinary()
+			err := new(Position).UnmarshalBinary(append(buf, 0))
+			Expect(err).To(MatchError(ErrMalformed))
+		})
+	})
+})
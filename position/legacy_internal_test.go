@@ -0,0 +1,295 @@
+package position
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/mezis/lseq/uid"
+)
+
+// bigPosition is the original `math/big` backing of `Position`: digits, and
+// digits interleaved with sites, packed into two variable-base integers.
+//
+// Kept to check that the current backing orders positions identically, and
+// to compare the costs of both.
+type bigPosition struct {
+	digits big.Int
+	length uint8
+	sites  big.Int
+}
+
+var bigSiteMask = new(big.Int).SetUint64(^uint64(0))
+
+func toBig(pos *Position) *bigPosition {
+	out := new(bigPosition)
+	for d := uint8(0); d < uint8(pos.Length()); d++ {
+		out = out.append(uint(pos.DigitAt(d)), pos.SiteAt(d))
+	}
+	return out
+}
+
+func (pos *bigPosition) append(digit uint, site uid.Uid) *bigPosition {
+	digitBits := uint(bitsAtDepth(pos.length))
+	out := new(bigPosition)
+	out.length = pos.length + 1
+
+	out.digits.Lsh(&pos.digits, digitBits)
+	out.digits.Or(&out.digits, new(big.Int).SetUint64(uint64(digit)))
+
+	out.sites.Lsh(&pos.sites, digitBits)
+	out.sites.Or(&out.sites, new(big.Int).SetUint64(uint64(digit)))
+	out.sites.Lsh(&out.sites, uid.Bits)
+	out.sites.Or(&out.sites, site.ToBig(new(big.Int)))
+	return out
+}
+
+// Pads both positions' sites in place, compares them as integers, and shifts
+// them back.
+func (pos *bigPosition) compare(oth *bigPosition) int {
+	padBits := func(a uint8, b uint8) uint {
+		out := uint(0)
+		for l := a; l < b; l++ {
+			out += uint(bitsAtDepth(l)) + uid.Bits
+		}
+		return out
+	}
+
+	posPad := padBits(pos.length, oth.length)
+	othPad := padBits(oth.length, pos.length)
+
+	if posPad > 0 {
+		pos.sites.Lsh(&pos.sites, posPad)
+	}
+	if othPad > 0 {
+		oth.sites.Lsh(&oth.sites, othPad)
+	}
+
+	res := pos.sites.Cmp(&oth.sites)
+
+	if posPad > 0 {
+		pos.sites.Rsh(&pos.sites, posPad)
+	}
+	if othPad > 0 {
+		oth.sites.Rsh(&oth.sites, othPad)
+	}
+	return res
+}
+
+func (pos *bigPosition) digitAt(out *big.Int, depth uint8) {
+	shiftBy := uint(0)
+	for d := pos.length - 1; d > depth; d-- {
+		shiftBy += uint(bitsAtDepth(d))
+	}
+	out.Rsh(&pos.digits, shiftBy)
+	out.And(out, big.NewInt(int64(maxDigitAtDepth(depth))))
+}
+
+func (pos *bigPosition) siteAt(out *big.Int, depth uint8) {
+	shiftBy := uint(0)
+	for d := pos.length - 1; d > depth; d-- {
+		shiftBy += uint(bitsAtDepth(d)) + uid.Bits
+	}
+	out.Rsh(&pos.sites, shiftBy)
+	out.And(out, bigSiteMask)
+}
+
+func (pos *bigPosition) interval(oth *bigPosition) int {
+	delta := new(big.Int).Sub(&pos.digits, &oth.digits)
+	return max(0, int(delta.Int64())-1)
+}
+
+// bigAllocator is the original allocator for `bigPosition`.
+type bigAllocator struct {
+	m       StrategyMap
+	n, p, q big.Int
+	lt, rt  bigPosition
+}
+
+func (alloc *bigAllocator) setPrefix(pos *bigPosition, oth *bigPosition, length uint8) {
+	shiftBits := func(a uint8, b uint8) uint {
+		out := uint(0)
+		for l := a; l < b; l++ {
+			out += uint(bitsAtDepth(l))
+		}
+		return out
+	}
+
+	if oth.length > length {
+		pos.digits.Rsh(&oth.digits, shiftBits(length, oth.length))
+	} else if oth.length < length {
+		pos.digits.Lsh(&oth.digits, shiftBits(oth.length, length))
+	} else {
+		pos.digits.Set(&oth.digits)
+	}
+	pos.length = length
+}
+
+func (alloc *bigAllocator) call(out *bigPosition, left *bigPosition, right *bigPosition, site uid.Uid) {
+	var interval int
+	var depth uint8
+	for depth = 1; depth < maxDigits; depth++ {
+		alloc.setPrefix(&alloc.lt, left, depth)
+		alloc.setPrefix(&alloc.rt, right, depth)
+		interval = alloc.rt.interval(&alloc.lt)
+		if interval >= 1 {
+			break
+		}
+	}
+
+	offset := rand.Intn(min(boundary, interval)) + 1
+
+	out.length = depth
+	out.sites.SetInt64(int64(0))
+
+	alloc.n.SetInt64(int64(offset))
+	switch alloc.m.Get(depth) {
+	case boundaryLoStrategy:
+		out.digits.Add(&alloc.lt.digits, &alloc.n)
+	case boundaryHiStrategy:
+		out.digits.Sub(&alloc.rt.digits, &alloc.n)
+	}
+
+	for d := uint8(0); d < out.length; d++ {
+		out.digitAt(&alloc.n, d)
+		left.digitAt(&alloc.p, d)
+		right.digitAt(&alloc.q, d)
+
+		out.sites.Lsh(&out.sites, uint(bitsAtDepth(d)))
+		out.sites.Or(&out.sites, &alloc.n)
+
+		if alloc.n.Cmp(&alloc.p) == 0 {
+			left.siteAt(&alloc.n, d)
+		} else if alloc.n.Cmp(&alloc.q) == 0 {
+			right.siteAt(&alloc.n, d)
+		} else {
+			site.ToBig(&alloc.n)
+		}
+
+		out.sites.Lsh(&out.sites, uid.Bits)
+		out.sites.Or(&out.sites, &alloc.n)
+	}
+}
+
+// Generate a random position of `length` digits, drawing digits and sites
+// from small ranges so that shared prefixes are common.
+func randomPosition(rnd *rand.Rand, length int) *Position {
+	out := new(Position)
+	for d := 0; d < length; d++ {
+		digit := uint(rnd.Intn(4))
+		if rnd.Intn(2) == 0 {
+			digit = uint(rnd.Intn(int(maxDigitAtDepth(uint8(d))) + 1))
+		}
+		out = out.Append(digit, uid.Uid(rnd.Intn(3)))
+	}
+	return out
+}
+
+// Generate `n` pairs of ordered positions of `length` digits, with room to
+// allocate between them.
+func randomPairs(rnd *rand.Rand, n int, length int) []*Position {
+	gen := func() *Position {
+		out := new(Position)
+		for d := 0; d < length; d++ {
+			digit := rnd.Intn(int(maxDigitAtDepth(uint8(d))))
+			out = out.Append(uint(digit), 0xFF)
+		}
+		return out
+	}
+
+	out := make([]*Position, 0, 2*n)
+	for len(out) < 2*n {
+		p, q := gen(), gen()
+		switch p.Compare(q) {
+		case -1:
+			out = append(out, p, q)
+		case 1:
+			out = append(out, q, p)
+		}
+	}
+	return out
+}
+
+func TestCompareMatchesBigBacking(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for k := 0; k < 100000; k++ {
+		p := randomPosition(rnd, rnd.Intn(maxDigits+1))
+		q := randomPosition(rnd, rnd.Intn(maxDigits+1))
+		if got, want := p.Compare(q), toBig(p).compare(toBig(q)); got != want {
+			t.Fatalf("Compare(%v, %v) = %d, want %d", p, q, got, want)
+		}
+	}
+}
+
+func TestIntervalMatchesBigBacking(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for k := 0; k < 100000; k++ {
+		length := 1 + rnd.Intn(4)
+		p := randomPosition(rnd, length)
+		q := randomPosition(rnd, length)
+		if got, want := p.Interval(q), toBig(p).interval(toBig(q)); got != want {
+			t.Fatalf("Interval(%v, %v) = %d, want %d", p, q, got, want)
+		}
+	}
+}
+
+var bmLengths = []int{24, 12, 6, 3, 1}
+
+func BenchmarkBackingCompare(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range bmLengths {
+		N := 1000
+		l := randomPairs(rnd, N, n)
+		lb := make([]*bigPosition, len(l))
+		for k, p := range l {
+			lb[k] = toBig(p)
+		}
+
+		b.Run(fmt.Sprintf("backing=pairs/length=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for k := 0; k < b.N; k++ {
+				j := k % N
+				l[2*j].Compare(l[2*j+1])
+			}
+		})
+		b.Run(fmt.Sprintf("backing=big/length=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for k := 0; k < b.N; k++ {
+				j := k % N
+				lb[2*j].compare(lb[2*j+1])
+			}
+		})
+	}
+}
+
+func BenchmarkBackingAllocate(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range bmLengths {
+		N := 1000
+		l := randomPairs(rnd, N, n)
+		lb := make([]*bigPosition, len(l))
+		for k, p := range l {
+			lb[k] = toBig(p)
+		}
+
+		b.Run(fmt.Sprintf("backing=pairs/length=%d", n), func(b *testing.B) {
+			alloc := NewAllocator()
+			var out Position
+			b.ReportAllocs()
+			for k := 0; k < b.N; k++ {
+				j := k % N
+				alloc.Call(&out, l[2*j], l[2*j+1], 0xF00F00F0)
+			}
+		})
+		b.Run(fmt.Sprintf("backing=big/length=%d", n), func(b *testing.B) {
+			alloc := new(bigAllocator)
+			var out bigPosition
+			b.ReportAllocs()
+			for k := 0; k < b.N; k++ {
+				j := k % N
+				alloc.call(&out, lb[2*j], lb[2*j+1], 0xF00F00F0)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package position
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mezis/lseq/uid"
+)
+
+// SyntaxError is returned when parsing text that is not in the format
+// produced by `String()`.
+type SyntaxError struct {
+	Text string // the full input
+	Msg  string // what went wrong
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position: cannot parse %q: %s", e.Text, e.Msg)
+}
+
+// Parse --
+// Return the position represented by `s`, in the format produced by
+// `String()`, eg. `<21 @DEADBEEF, 43 @F00F00F0>`, or `<8/2/12: 21, 43>` for
+// positions not of the `DefaultShape`.
+func Parse(s string) (*Position, error) {
+	fail := func(msg string) (*Position, error) {
+		return nil, &SyntaxError{Text: s, Msg: msg}
+	}
+
+	if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") || len(s) < 2 {
+		return fail("missing angle brackets")
+	}
+	body := s[1 : len(s)-1]
+	shape := defaultShape
+	if shapeStr, rest, hasShape := strings.Cut(body, ":"); hasShape {
+		var err error
+		if shape, err = parseShape(shapeStr); err != nil {
+			return fail(err.Error())
+		}
+		if err = shape.Validate(); err != nil {
+			return nil, err
+		}
+		body = strings.TrimPrefix(rest, " ")
+	}
+	out := shape.New()
+	if body == "" {
+		return out, nil
+	}
+
+	items := strings.Split(body, ", ")
+	if len(items) > int(shape.MaxDigits) {
+		return nil, LengthError(len(items))
+	}
+	for d, item := range items {
+		digitStr, siteStr, hasSite := strings.Cut(item, " @")
+
+		digit, err := strconv.ParseUint(digitStr, 10, 64)
+		if err != nil {
+			return fail(fmt.Sprintf("bad digit %q", digitStr))
+		}
+		if digit > uint64(shape.maxDigitAt(uint8(d))) {
+			return nil, &DigitError{Depth: uint8(d), Digit: digit}
+		}
+
+		var site uint64
+		if hasSite {
+			site, err = strconv.ParseUint(siteStr, 16, 64)
+			if err != nil {
+				return fail(fmt.Sprintf("bad site %q", siteStr))
+			}
+		}
+
+		out = out.Append(uint(digit), uid.Uid(site))
+	}
+	return out, nil
+}
+
+// Parse a shape in the format of `TreeShape.String()`.
+func parseShape(s string) (TreeShape, error) {
+	var out TreeShape
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return out, fmt.Errorf("bad shape %q", s)
+	}
+	for k, ptr := range []*uint8{&out.RootBits, &out.Growth, &out.MaxDigits} {
+		val, err := strconv.ParseUint(parts[k], 10, 8)
+		if err != nil {
+			return out, fmt.Errorf("bad shape %q", s)
+		}
+		*ptr = uint8(val)
+	}
+	return out, nil
+}
+
+// MarshalText --
+// Implement `encoding.TextMarshaler`, using the same format as `String()`.
+func (pos *Position) MarshalText() ([]byte, error) {
+	return []byte(pos.String()), nil
+}
+
+// UnmarshalText --
+// Implement `encoding.TextUnmarshaler`, accepting the format of `String()`.
+func (pos *Position) UnmarshalText(text []byte) error {
+	out, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	pos.ids = out.ids
+	pos.shape = out.shape
+	return nil
+}
@@ -0,0 +1,87 @@
+package position_test
+
+import (
+	"encoding/json"
+
+	. "github.com/mezis/lseq/position"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Parse", func() {
+	It("parses what String() emits", func() {
+		p, err := Parse("<21 @DEADBEEF, 43 @F00F00F0>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.DigitAt(0)).To(Equal(21))
+		Expect(p.DigitAt(1)).To(Equal(43))
+		Expect(p.String()).To(Equal("<21 @DEADBEEF, 43 @F00F00F0>"))
+	})
+
+	It("parses the empty position", func() {
+		p, err := Parse("<>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Length()).To(Equal(0))
+	})
+
+	It("parses digits without sites", func() {
+		p, err := Parse("<31>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Compare(SentinelTail)).To(Equal(0))
+	})
+
+	It("round-trips random positions", func() {
+		for k := 0; k < 1000; k++ {
+			p := genPosition(uint(k%24 + 1))
+			q, err := Parse(p.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q.Compare(p)).To(Equal(0))
+		}
+	})
+
+	It("rejects out-of-range digits", func() {
+		_, err := Parse("<21, 64>")
+		Expect(err).To(Equal(&DigitError{Depth: 1, Digit: 64}))
+	})
+
+	It("rejects excessive lengths", func() {
+		_, err := Parse("<0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0>")
+		Expect(err).To(Equal(LengthError(27)))
+	})
+
+	It("rejects malformed text", func() {
+		for _, s := range []string{"", "<", "21", "<21 DEADBEEF>", "<21,43>", "<x>", "<21 @XYZ>", "<-1>"} {
+			_, err := Parse(s)
+			Expect(err).To(BeAssignableToTypeOf(&SyntaxError{}), s)
+		}
+	})
+})
+
+var _ = Describe("Position text encoding", func() {
+	It("can be used as JSON map keys", func() {
+		in := map[*Position]string{
+			makePosition(21, 42): "foo",
+		}
+		buf, err := json.Marshal(in)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(Equal(`{"\u003c21 @DEADBEEF, 42 @DEADBEEF\u003e":"foo"}`))
+
+		var out map[*Position]string
+		Expect(json.Unmarshal(buf, &out)).To(Succeed())
+		Expect(out).To(HaveLen(1))
+		for k, v := range out {
+			Expect(k.String()).To(Equal("<21 @DEADBEEF, 42 @DEADBEEF>"))
+			Expect(v).To(Equal("foo"))
+		}
+	})
+
+	It("round-trips as JSON values", func() {
+		p := makePosition(3, 4, 5)
+		buf, err := json.Marshal(p)
+		Expect(err).NotTo(HaveOccurred())
+
+		q := new(Position)
+		Expect(json.Unmarshal(buf, q)).To(Succeed())
+		Expect(q.Compare(p)).To(Equal(0))
+	})
+})
@@ -2,7 +2,6 @@ package position
 
 import (
 	"fmt"
-	"math/big"
 	"strings"
 
 	"github.com/mezis/lseq/uid"
@@ -10,59 +9,44 @@ import (
 
 // Position - An immutable position in a document
 type Position struct {
-	// A variable-base number; the first digit is the `rootBits` most
-	// significant bits of `value`; the second digit is the next
-	// `rootBits+1` bits, etc.
-	digits big.Int
-
-	// The number of variable-base digits in `value`
-	length uint8
+	// The (digit, site) pairs, most significant first. A digit at depth `d`
+	// has `shape.bitsAt(d)` bits.
+	ids []ident
+	// The shape of the tree this position belongs to; nil for `DefaultShape`.
+	shape *TreeShape
+}
 
-	// Same as `value`, but interleaved with site identifiers (`uid.Uid`).
-	// This allows for fully ordered comparison between positions.
-	sites big.Int
+// One level of a position: a variable-base digit, and the site identifier
+// (`uid.Uid`) which allocated it. Sites allow for fully ordered comparison
+// between positions.
+type ident struct {
+	digit uint32
+	site  uid.Uid
 }
 
 // Number of bits used for the first (most significant) digit, ie. the root of
-// the tree.
-const rootBits uint = 5
+// the tree, in the `DefaultShape`.
+const rootBits = 5
 
-// Maximum tree depth (ie. position length); results in 31-bit digits at the
-// deepest level.
+// Maximum tree depth (ie. position length) in the `DefaultShape`; results in
+// 30-bit digits at the deepest level.
 const maxDigits = 26
 
 // How many free identifiers to leave before or after the first allocation at a
-// new tree depth.
+// new tree depth, unless configured otherwise.
 const boundary = 10
 
-// The maximum digit value at a given tree depth.
+// The maximum digit value at a given tree depth of the `DefaultShape`.
 // Note that is is also usable as a bitmask.
 func maxDigitAtDepth(depth uint8) uint {
-	return 1<<uint(bitsAtDepth(depth)) - 1
+	return defaultShape.maxDigitAt(depth)
 }
 
-// Number of bits for indices a the given tree depth.
+// Number of bits for indices a the given tree depth of the `DefaultShape`.
 func bitsAtDepth(depth uint8) uint8 {
-	return uint8(rootBits) + depth
+	return defaultShape.bitsAt(depth)
 }
 
-// Precalculated 64-bit mask
-var siteMask = func() *big.Int {
-	one := big.NewInt(1)
-	two64 := new(big.Int).Lsh(one, uid.Bits)
-	mask := new(big.Int).Sub(two64, one)
-	return mask
-}()
-
-// Precalculated masks for digits with variable bases
-var digitMask = func() []*big.Int {
-	out := make([]*big.Int, maxDigits)
-	for d := uint8(0); d < maxDigits; d++ {
-		out[d] = big.NewInt(int64(maxDigitAtDepth(d)))
-	}
-	return out
-}()
-
 func min(x, y int) int {
 	if x < y {
 		return x
@@ -77,6 +61,8 @@ func max(x, y int) int {
 	return y
 }
 
+// New -
+// Return an empty position of the `DefaultShape`.
 func New() *Position {
 	return new(Position)
 }
@@ -88,165 +74,194 @@ var SentinelTail = new(Position).Append(maxDigitAtDepth(0), 0)
 // Return true iff "pos" is before "oth" in the partial order defined by Logoot.
 //
 // In practice, this is the lexicographical order on the list of (identifier,
-// site) pairs, implemented as integer comparison after padding.
+// site) pairs, the shorter position being padded with zeroes.
 func (pos *Position) IsBefore(oth *Position) bool {
 	return pos.Compare(oth) < 0
 }
 
 // Compare returns -1 when the argument position is greater, 0 if equal, and 1
 // if lower.
+//
+// Pairs of digits and sites are compared depth by depth, treating missing
+// pairs as zeroes; neither position is modified, so concurrent comparisons
+// are safe. Both positions should have the same shape.
 func (pos *Position) Compare(oth *Position) int {
-	// how many bits to left-shift `sites` by, if currently of length `a`,
-	// to be length `b` ?
-	padBits := func(a uint8, b uint8) uint {
-		out := uint(0)
-		for l := a; l < b; l++ {
-			out += uint(bitsAtDepth(l)) + uid.Bits
-		}
-		return out
+	if debug && !pos.SameShape(oth) {
+		panic(fmt.Sprint("comparing positions of different shapes ", pos, oth))
 	}
 
-	posPad := padBits(pos.length, oth.length)
-	othPad := padBits(oth.length, pos.length)
-
-	// pad both positions' sites, and reset after comparing (to avoids allocations
-	// of padded positions)
-	if posPad > 0 {
-		pos.sites.Lsh(&pos.sites, posPad)
+	length := len(pos.ids)
+	if len(oth.ids) > length {
+		length = len(oth.ids)
 	}
-	if othPad > 0 {
-		oth.sites.Lsh(&oth.sites, othPad)
+
+	for d := 0; d < length; d++ {
+		p, o := pos.identAt(d), oth.identAt(d)
+		switch {
+		case p.digit < o.digit:
+			return -1
+		case p.digit > o.digit:
+			return 1
+		case p.site < o.site:
+			return -1
+		case p.site > o.site:
+			return 1
+		}
 	}
+	return 0
+}
 
-	res := pos.sites.Cmp(&oth.sites)
+// Return the (digit, site) pair at `depth`, or zeroes past the end of the
+// position.
+func (pos *Position) identAt(depth int) ident {
+	if depth >= len(pos.ids) {
+		return ident{}
+	}
+	return pos.ids[depth]
+}
 
-	if posPad > 0 {
-		pos.sites.Rsh(&pos.sites, posPad)
+func (pos *Position) equals(oth *Position) bool {
+	if len(pos.ids) != len(oth.ids) || !pos.SameShape(oth) {
+		return false
 	}
-	if othPad > 0 {
-		oth.sites.Rsh(&oth.sites, othPad)
+	for d := range pos.ids {
+		if pos.ids[d] != oth.ids[d] {
+			return false
+		}
 	}
+	return true
+}
 
-	return res
+// Shape -
+// Return the shape of the tree `pos` belongs to. Positions don't record
+// allocation boundaries, so its `Boundary` is unset.
+func (pos *Position) Shape() TreeShape {
+	if pos.shape == nil {
+		out := defaultShape
+		out.Boundary = 0
+		return out
+	}
+	return *pos.shape
 }
 
-func (pos *Position) equals(oth *Position) bool {
-	return pos.length == oth.length && pos.sites.Cmp(&oth.sites) == 0
+// SameShape -
+// Return true iff `pos` and `oth` belong to trees of the same shape, ie. can
+// be compared.
+func (pos *Position) SameShape(oth *Position) bool {
+	return pos.shape == oth.shape || pos.layout().Compatible(*oth.layout())
+}
+
+// Return the shape of `pos`, defaulting to `DefaultShape`.
+func (pos *Position) layout() *TreeShape {
+	if pos.shape == nil {
+		return &defaultShape
+	}
+	return pos.shape
 }
 
 // Append an identifier (index and site identifier) to the position,
 // returning the new position
 func (pos *Position) Append(digit uint, site uid.Uid) *Position {
-	if pos.length >= maxDigits {
+	shape := pos.layout()
+	if len(pos.ids) >= int(shape.MaxDigits) {
 		return nil // max position length reached
 	}
 
-	digitBits := uint(bitsAtDepth(pos.length))
-	if digit >= 1<<digitBits {
+	if digit > shape.maxDigitAt(uint8(len(pos.ids))) {
 		return nil // bad index value"
 	}
 
 	out := new(Position)
-	out.length = pos.length + 1
-
-	out.digits.Lsh(&pos.digits, digitBits)
-	out.digits.Or(&out.digits, new(big.Int).SetUint64(uint64(digit)))
-
-	out.sites.Lsh(&pos.sites, digitBits)
-	out.sites.Or(&out.sites, new(big.Int).SetUint64(uint64(digit)))
-	out.sites.Lsh(&out.sites, uid.Bits)
-	out.sites.Or(&out.sites, site.ToBig(new(big.Int)))
-
+	out.shape = pos.shape
+	out.ids = make([]ident, len(pos.ids)+1)
+	copy(out.ids, pos.ids)
+	out.ids[len(pos.ids)] = ident{uint32(digit), site}
 	return out
 }
 
 // Length --
 // Return the number of digits in this position.
 func (pos *Position) Length() int {
-	return int(pos.length)
-}
-
-// put the Nth digit of `pos` into `out`
-func (pos *Position) digitAt(out *big.Int, depth uint8) {
-	if depth >= pos.length {
-		out.SetUint64(uint64(0))
-	}
-	shiftBy := uint(0)
-	for d := pos.length - 1; d > depth; d-- {
-		shiftBy += uint(bitsAtDepth(d))
-	}
-	out.Rsh(&pos.digits, shiftBy)
-	mask := digitMask[depth]
-	out.And(out, mask)
+	return len(pos.ids)
 }
 
 // DigitAt -
 // Return the value of the `depth`s most significant digit.
 func (pos *Position) DigitAt(depth uint8) int {
-	if pos.length <= depth {
+	if int(depth) >= len(pos.ids) {
 		return 0
 	}
-
-	var val big.Int
-	pos.digitAt(&val, depth)
-	return int(val.Int64())
-}
-
-func (pos *Position) siteAt(out *big.Int, depth uint8) {
-	if depth >= pos.length {
-		out.SetUint64(uint64(0))
-	}
-	shiftBy := uint(0)
-	for d := pos.length - 1; d > depth; d-- {
-		shiftBy += uint(bitsAtDepth(d)) + uid.Bits
-	}
-
-	out.Rsh(&pos.sites, shiftBy)
-	out.And(out, siteMask)
+	return int(pos.ids[depth].digit)
 }
 
 // SiteAt -
 // Return the value of the site identifier for the `depth`'s most significant
 // digit.
 func (pos *Position) SiteAt(depth uint8) uid.Uid {
-	if pos.length <= depth {
+	if int(depth) >= len(pos.ids) {
 		return 0
 	}
-
-	var val big.Int
-	pos.siteAt(&val, depth)
-	return uid.New(&val)
+	return pos.ids[depth].site
 }
 
 // Interval -
 // Return the distance, in number of free identifiers, between "pos" and "oth"
+//
+// Saturates at `maxInterval`.
 func (pos *Position) Interval(oth *Position) int {
-	if debug && pos.length != oth.length {
+	if debug && len(pos.ids) != len(oth.ids) {
 		// TODO: this could be supported with padding. necessary?
 		panic("positions have different lengths")
 	}
-	delta := new(big.Int).Sub(&pos.digits, &oth.digits)
-	if debug && !delta.IsInt64() {
-		panic(fmt.Sprintf("interval from %#v to %#v is out of bounds", oth, pos))
+	shape := pos.layout()
+	delta := int64(0)
+	for d := range pos.ids {
+		delta = widen(delta, shape.bitsAt(uint8(d)), int64(pos.ids[d].digit)-int64(oth.ids[d].digit))
 	}
-	interval := int(delta.Int64()) - 1
+	return max(0, int(delta)-1)
+}
 
-	return max(0, interval)
+// Upper bound for intervals; larger intervals are reported as this.
+const maxInterval = 1 << 62
+
+// Return the difference `delta` between two prefixes, extended by one digit
+// of `bits` bits whose values differ by `digitDelta`. Saturates at
+// +/-`maxInterval`.
+func widen(delta int64, bits uint8, digitDelta int64) int64 {
+	switch {
+	case delta >= maxInterval>>bits:
+		return maxInterval
+	case delta <= -maxInterval>>bits:
+		return -maxInterval
+	}
+	delta = delta<<bits + digitDelta
+	switch {
+	case delta > maxInterval:
+		return maxInterval
+	case delta < -maxInterval:
+		return -maxInterval
+	}
+	return delta
 }
 
 // String --
 // Implement `fmt.Stringer` so that the `%v` placeholder works for `Position`
 // values.
+//
+// Positions not of the `DefaultShape` are prefixed with their shape, eg.
+// `<8/2/12: 21, 43>`.
 func (pos *Position) String() string {
-	l := make([]string, pos.length)
-	for d := uint8(0); d < pos.length; d++ {
-		s := pos.SiteAt(d)
-		if s == 0 {
-			l[d] = fmt.Sprintf("%d", pos.DigitAt(d))
+	l := make([]string, len(pos.ids))
+	for d, id := range pos.ids {
+		if id.site == 0 {
+			l[d] = fmt.Sprintf("%d", id.digit)
 		} else {
-			l[d] = fmt.Sprintf("%d %#v", pos.DigitAt(d), s)
+			l[d] = fmt.Sprintf("%d %#v", id.digit, id.site)
 		}
 	}
+	if pos.shape != nil {
+		return fmt.Sprintf("<%v: %s>", pos.shape, strings.Join(l, ", "))
+	}
 	return fmt.Sprintf("<%s>", strings.Join(l, ", "))
 }
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"runtime"
+	"sync"
 	"testing"
 
 	. "github.com/mezis/lseq/position"
@@ -153,6 +154,46 @@ var _ = Describe("Position", func() {
 			check(p1, p2)
 		})
 	})
+
+	Describe("Compare", func() {
+		It("treats missing digits as zeroes", func() {
+			p1 := makePosition(21)
+			p2 := new(Position).Append(21, 0xDEADBEEF).Append(0, 0)
+			Expect(p1.Compare(p2)).To(Equal(0))
+			Expect(p2.Compare(p1)).To(Equal(0))
+		})
+
+		It("does not modify its operands", func() {
+			p1 := makePosition(21, 42, 1)
+			p2 := makePosition(21)
+			s1, s2 := p1.String(), p2.String()
+			p1.Compare(p2)
+			p2.Compare(p1)
+			Expect(p1.String()).To(Equal(s1))
+			Expect(p2.String()).To(Equal(s2))
+		})
+
+		// Meaningful when run with `go test -race`.
+		It("is safe for concurrent readers of shared positions", func() {
+			shared := []*Position{SentinelHead, SentinelTail, makePosition(21, 42)}
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for k := 0; k < 1000; k++ {
+						p := genPosition(uint(1 + (g+k)%12))
+						for _, s := range shared {
+							Expect(p.Compare(s)).To(Equal(-s.Compare(p)))
+						}
+						Expect(SentinelHead.IsBefore(SentinelTail)).To(BeTrue())
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	})
 })
 
 var bmLengths = []uint{24, 12, 6, 3, 1}
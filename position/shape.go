@@ -0,0 +1,133 @@
+package position
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Upper bound on `TreeShape.MaxDigits`, which sizes the allocator's and the
+// `StrategyMap`'s storage.
+const maxDepth = 32
+
+// Digits are stored as `uint32`.
+const maxBits = 32
+
+// ErrShapeMismatch is returned when positions of different tree shapes are
+// mixed, eg. when merging replicas created with different shapes.
+var ErrShapeMismatch = errors.New("position: positions have different tree shapes")
+
+// TreeShape -
+// The shape of the tree of positions: digits have `RootBits` bits at the root
+// and `Growth` more at each depth below, and positions have at most
+// `MaxDigits` digits.
+//
+// A wide root and little growth suit documents with many atoms edited all
+// over, eg. lines of a wiki page; a narrow root with more growth suits short
+// documents edited at one end, eg. characters typed in a chat.
+//
+// Positions only order meaningfully against positions of the same shape, so
+// all replicas of a document must share it; serialized positions carry their
+// shape so that mismatches are detected.
+type TreeShape struct {
+	RootBits  uint8
+	Growth    uint8
+	MaxDigits uint8
+
+	// Default boundary of the allocation strategy, when an `Allocator` is
+	// built with this shape and without `WithStrategy`. Does not affect
+	// ordering, so it isn't serialized; defaults to 10.
+	Boundary int
+}
+
+// The shape of positions created without one; see `DefaultShape`.
+var defaultShape = TreeShape{RootBits: rootBits, Growth: 1, MaxDigits: maxDigits, Boundary: boundary}
+
+// DefaultShape -
+// Return the shape of positions created without one: 5 bits at the root,
+// growing by one bit per depth, up to 26 digits of 30 bits.
+func DefaultShape() TreeShape {
+	return defaultShape
+}
+
+// ShapeError is returned for tree shapes that cannot be used.
+type ShapeError struct {
+	Shape TreeShape
+	Msg   string // what is wrong with it
+}
+
+func (e *ShapeError) Error() string {
+	return fmt.Sprintf("position: invalid tree shape %v: %s", e.Shape, e.Msg)
+}
+
+// Validate -
+// Return a `*ShapeError` unless positions can be allocated in this shape.
+func (s TreeShape) Validate() error {
+	fail := func(msg string) error {
+		return &ShapeError{Shape: s, Msg: msg}
+	}
+	switch {
+	case s.RootBits < 1:
+		return fail("root needs at least one bit")
+	case s.MaxDigits < 1:
+		return fail("positions need at least one digit")
+	case s.MaxDigits > maxDepth:
+		return fail(fmt.Sprintf("more than %d digits", maxDepth))
+	case int(s.RootBits)+int(s.Growth)*int(s.MaxDigits-1) > maxBits:
+		return fail(fmt.Sprintf("digits wider than %d bits", maxBits))
+	case s.Boundary < 0:
+		return fail("negative boundary")
+	}
+	return nil
+}
+
+// Compatible -
+// Return true iff positions of shapes `s` and `oth` order consistently, ie.
+// the shapes only differ by their `Boundary`.
+func (s TreeShape) Compatible(oth TreeShape) bool {
+	return s.RootBits == oth.RootBits && s.Growth == oth.Growth && s.MaxDigits == oth.MaxDigits
+}
+
+// New -
+// Return an empty position of this shape.
+func (s TreeShape) New() *Position {
+	return &Position{shape: s.ref()}
+}
+
+// Head -
+// Return the position of the start sentinel of documents of this shape.
+func (s TreeShape) Head() *Position {
+	return s.New().Append(0, 0)
+}
+
+// Tail -
+// Return the position of the end sentinel of documents of this shape.
+func (s TreeShape) Tail() *Position {
+	return s.New().Append(s.maxDigitAt(0), 0)
+}
+
+// String --
+// Implement `fmt.Stringer`, as root bits, growth, and maximum digits, eg.
+// `5/1/26`.
+func (s TreeShape) String() string {
+	return fmt.Sprintf("%d/%d/%d", s.RootBits, s.Growth, s.MaxDigits)
+}
+
+// Return the reference positions keep to their shape: nil for the default
+// shape, so that positions of that shape need no storage for it.
+func (s TreeShape) ref() *TreeShape {
+	if s.Compatible(defaultShape) {
+		return nil
+	}
+	s.Boundary = 0
+	return &s
+}
+
+// Number of bits of digits at the given tree depth.
+func (s *TreeShape) bitsAt(depth uint8) uint8 {
+	return s.RootBits + s.Growth*depth
+}
+
+// The maximum digit value at a given tree depth; also usable as a bitmask.
+func (s *TreeShape) maxDigitAt(depth uint8) uint {
+	return 1<<uint(s.bitsAt(depth)) - 1
+}
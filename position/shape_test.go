@@ -0,0 +1,138 @@
+package position_test
+
+import (
+	. "github.com/mezis/lseq/position"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TreeShape", func() {
+	wide := TreeShape{RootBits: 12, Growth: 0, MaxDigits: 8}
+	narrow := TreeShape{RootBits: 3, Growth: 2, MaxDigits: 12}
+
+	Describe("DefaultShape", func() {
+		It("returns a copy", func() {
+			s := DefaultShape()
+			s.RootBits = 12
+			Expect(DefaultShape().RootBits).To(Equal(uint8(5)))
+			Expect(NewAllocator().Shape().RootBits).To(Equal(uint8(5)))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("accepts the default shape", func() {
+			Expect(DefaultShape().Validate()).To(Succeed())
+		})
+
+		It("accepts shapes whose deepest digits fit 32 bits", func() {
+			Expect(wide.Validate()).To(Succeed())
+			Expect(narrow.Validate()).To(Succeed())
+			Expect(TreeShape{RootBits: 1, Growth: 1, MaxDigits: 32}.Validate()).To(Succeed())
+		})
+
+		It("rejects unusable shapes", func() {
+			for _, s := range []TreeShape{
+				{RootBits: 0, Growth: 1, MaxDigits: 26},
+				{RootBits: 5, Growth: 1, MaxDigits: 0},
+				{RootBits: 1, Growth: 0, MaxDigits: 33},
+				{RootBits: 8, Growth: 2, MaxDigits: 14},
+				{RootBits: 5, Growth: 1, MaxDigits: 26, Boundary: -1},
+			} {
+				Expect(s.Validate()).To(BeAssignableToTypeOf(&ShapeError{}), s.String())
+			}
+		})
+	})
+
+	Describe("Compatible", func() {
+		It("ignores boundaries", func() {
+			s := DefaultShape()
+			s.Boundary = 100
+			Expect(s.Compatible(DefaultShape())).To(BeTrue())
+			Expect(wide.Compatible(DefaultShape())).To(BeFalse())
+		})
+	})
+
+	Describe("Head and Tail", func() {
+		It("span the root", func() {
+			Expect(narrow.Head().String()).To(Equal("<3/2/12: 0>"))
+			Expect(narrow.Tail().String()).To(Equal("<3/2/12: 7>"))
+			Expect(DefaultShape().Tail().Compare(SentinelTail)).To(Equal(0))
+		})
+	})
+
+	Describe("positions", func() {
+		It("are bounded by their shape", func() {
+			p := narrow.New().Append(7, 0)
+			Expect(p).NotTo(BeNil())
+			Expect(p.Append(31, 0)).NotTo(BeNil())
+			Expect(p.Append(32, 0)).To(BeNil())
+			Expect(p.Shape()).To(Equal(narrow))
+		})
+
+		It("round-trip through binary encoding with their shape", func() {
+			p := narrow.New().Append(5, 0xDEADBEEF).Append(17, 0xF00F00F0)
+			buf, err := p.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			q := new(Position)
+			Expect(q.UnmarshalBinary(buf)).To(Succeed())
+			Expect(q.Shape()).To(Equal(narrow))
+			Expect(q.String()).To(Equal(p.String()))
+		})
+
+		It("round-trip through text with their shape", func() {
+			p := wide.New().Append(4000, 0xDEADBEEF).Append(17, 0)
+			Expect(p.String()).To(Equal("<12/0/8: 4000 @DEADBEEF, 17>"))
+			q, err := Parse(p.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q.Shape()).To(Equal(wide))
+			Expect(q.Compare(p)).To(Equal(0))
+		})
+
+		It("decode the default shape", func() {
+			p := new(Position)
+			Expect(p.UnmarshalBinary([]byte{1, 5, 1, 26, 1, 21, 1, 0, 0, 0, 0, 0xDE, 0xAD, 0xBE, 0xEF})).To(Succeed())
+			Expect(p.String()).To(Equal("<21 @DEADBEEF>"))
+			Expect(p.Shape().Compatible(DefaultShape())).To(BeTrue())
+		})
+
+		It("reject invalid shapes when decoding", func() {
+			_, err := Parse("<40/0/1: 1>")
+			Expect(err).To(BeAssignableToTypeOf(&ShapeError{}))
+			err = new(Position).UnmarshalBinary([]byte{1, 40, 0, 1, 0})
+			Expect(err).To(BeAssignableToTypeOf(&ShapeError{}))
+		})
+
+		It("reject digits out of their shape", func() {
+			_, err := Parse("<3/2/12: 8>")
+			Expect(err).To(Equal(&DigitError{Depth: 0, Digit: 8}))
+		})
+	})
+
+	Describe("Allocator", func() {
+		It("allocates ordered positions of its shape", func() {
+			for _, s := range []TreeShape{wide, narrow} {
+				a := NewAllocator(WithShape(s))
+				left, right := s.Head(), s.Tail()
+				for k := 0; k < 200; k++ {
+					q := new(Position)
+					Expect(a.Call(q, left, right, 0xF00F00F0)).To(Succeed())
+					Expect(q.Shape()).To(Equal(s))
+					Expect(left.IsBefore(q)).To(BeTrue())
+					Expect(q.IsBefore(right)).To(BeTrue())
+					left = q
+				}
+			}
+		})
+
+		It("refuses positions of other shapes", func() {
+			a := NewAllocator(WithShape(narrow))
+			err := a.Call(new(Position), SentinelHead, SentinelTail, 0xF00F00F0)
+			Expect(err).To(MatchError(ErrShapeMismatch))
+		})
+
+		It("panics on invalid shapes", func() {
+			Expect(func() { WithShape(TreeShape{}) }).To(Panic())
+		})
+	})
+})
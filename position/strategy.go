@@ -1,12 +1,42 @@
 package position
 
-import "math/rand"
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Strategy -
+// Decides where to allocate new digits, within the free interval found by an
+// `Allocator` at some depth.
+//
+// Strategies trade identifier growth for different editing patterns; see
+// "LSEQ: an Adaptive Structure for Sequences in Distributed Collaborative
+// Editing" (Nédelec et al., 2013).
+type Strategy interface {
+	// Offset returns how many identifiers past the left bound to allocate at,
+	// between 1 and `interval` (the number of free identifiers) inclusive.
+	// `depth` is that of the new digit, and `rnd` is the allocator's source of
+	// randomness.
+	Offset(depth uint8, interval int, rnd *rand.Rand) int
+}
 
 type strategy uint8
 
 // StrategyMap -
 // Which strategy was picked at a given digit depth.
-type StrategyMap [maxDigits]strategy
+//
+// A replica should persist its map, so that it keeps the same strategies after
+// restarting; `MarshalBinary` returns one byte per depth, up to the deepest
+// one used:
+//
+//	buf, err := alloc.Strategy().(*position.LSEQ).Map.MarshalBinary()
+//
+// and the map is restored into a new allocator with:
+//
+//	s := new(position.LSEQ)
+//	err := s.Map.UnmarshalBinary(buf)
+//	alloc := position.NewAllocator(position.WithStrategy(s))
+type StrategyMap [maxDepth]strategy
 
 const (
 	UndefinedStrategy strategy = iota
@@ -18,11 +48,149 @@ const strategyCount = int(boundaryHiStrategy)
 // Get --
 // Return the stategy for "depth", if needed by picking a random one and
 // updating the map.
+//
+// Picks from the global `math/rand` source; allocators pick from their own.
 func (m *StrategyMap) Get(depth uint8) strategy {
+	return m.get(depth, rand.Intn)
+}
+
+func (m *StrategyMap) get(depth uint8, intn func(int) int) strategy {
 	s := m[depth]
 	if s == UndefinedStrategy {
-		s = strategy(rand.Intn(strategyCount) + 1)
+		s = strategy(intn(strategyCount) + 1)
 		m[depth] = s
 	}
 	return s
 }
+
+// MarshalBinary --
+// Implement `encoding.BinaryMarshaler`.
+func (m *StrategyMap) MarshalBinary() ([]byte, error) {
+	n := len(m)
+	for n > 0 && m[n-1] == UndefinedStrategy {
+		n--
+	}
+	out := make([]byte, n)
+	for d := range out {
+		out[d] = byte(m[d])
+	}
+	return out, nil
+}
+
+// UnmarshalBinary --
+// Implement `encoding.BinaryUnmarshaler`.
+func (m *StrategyMap) UnmarshalBinary(data []byte) error {
+	if len(data) > len(m) {
+		return fmt.Errorf("position: strategy map has %d depths, expected at most %d", len(data), len(m))
+	}
+	for d, b := range data {
+		if int(b) > strategyCount {
+			return fmt.Errorf("position: unknown strategy %d at depth %d", b, d)
+		}
+	}
+	*m = StrategyMap{}
+	for d, b := range data {
+		m[d] = strategy(b)
+	}
+	return nil
+}
+
+// Return `b`, or the default `boundary` if unset.
+func boundaryOr(b int) int {
+	if b <= 0 {
+		return boundary
+	}
+	return b
+}
+
+// Logoot -
+// Allocates uniformly at random in the free interval, as in the original
+// Logoot. Identifiers grow linearly under sequential editing.
+type Logoot struct{}
+
+// Offset implements `Strategy`.
+func (Logoot) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return rnd.Intn(interval) + 1
+}
+
+// BoundaryPlus -
+// Allocates at random within `Boundary` identifiers after the left bound,
+// leaving room for later insertions to the right. Suits appending.
+type BoundaryPlus struct {
+	Boundary int // defaults to 10
+}
+
+// Offset implements `Strategy`.
+func (s BoundaryPlus) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return rnd.Intn(min(boundaryOr(s.Boundary), interval)) + 1
+}
+
+// BoundaryMinus -
+// Allocates at random within `Boundary` identifiers before the right bound,
+// leaving room for later insertions to the left. Suits prepending.
+type BoundaryMinus struct {
+	Boundary int // defaults to 10
+}
+
+// Offset implements `Strategy`.
+func (s BoundaryMinus) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return interval - rnd.Intn(min(boundaryOr(s.Boundary), interval))
+}
+
+// LSEQ -
+// Picks `BoundaryPlus` or `BoundaryMinus` at random the first time each depth
+// is used, and remembers the choice in `Map`. This is the default strategy.
+type LSEQ struct {
+	Map      StrategyMap
+	Boundary int // defaults to 10
+}
+
+// Offset implements `Strategy`.
+func (s *LSEQ) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return pickBoundary(s.Map.get(depth, rnd.Intn), s.Boundary, depth, interval, rnd)
+}
+
+// HashLSEQ -
+// Like `LSEQ`, but picks `BoundaryPlus` or `BoundaryMinus` for each depth by
+// hashing it with `Seed`. Replicas sharing a seed agree on their choices
+// without exchanging a `StrategyMap`.
+type HashLSEQ struct {
+	Seed     uint64
+	Boundary int // defaults to 10
+}
+
+// Offset implements `Strategy`.
+func (s HashLSEQ) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return pickBoundary(s.strategyAt(depth), s.Boundary, depth, interval, rnd)
+}
+
+func (s HashLSEQ) strategyAt(depth uint8) strategy {
+	// splitmix64 finaliser
+	h := s.Seed + uint64(depth)*0x9E3779B97F4A7C15
+	h = (h ^ h>>30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h>>27) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return strategy(int(h%uint64(strategyCount)) + 1)
+}
+
+func pickBoundary(s strategy, b int, depth uint8, interval int, rnd *rand.Rand) int {
+	switch s {
+	case boundaryLoStrategy:
+		return BoundaryPlus{b}.Offset(depth, interval, rnd)
+	case boundaryHiStrategy:
+		return BoundaryMinus{b}.Offset(depth, interval, rnd)
+	default:
+		panic("unknown strategy " + s.String())
+	}
+}
+
+// Sequential -
+// Allocates immediately after the left bound. Tuned for typing, ie. repeated
+// appends after the last allocated position, where it packs each depth
+// densely before growing identifiers.
+type Sequential struct{}
+
+// Offset implements `Strategy`.
+func (Sequential) Offset(depth uint8, interval int, rnd *rand.Rand) int {
+	return 1
+}
@@ -1,6 +1,10 @@
 package position_test
 
 import (
+	"fmt"
+	"math/rand"
+	"testing"
+
 	. "github.com/mezis/lseq/position"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -25,3 +29,143 @@ var _ = Describe("StrategyMap", func() {
 		})
 	})
 })
+
+var _ = Describe("StrategyMap", func() {
+	Describe("MarshalBinary", func() {
+		It("round-trips", func() {
+			var m1, m2 StrategyMap
+			for d := uint8(0); d < maxDigits; d += 3 {
+				m1.Get(d)
+			}
+			buf, err := m1.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m2.UnmarshalBinary(buf)).To(Succeed())
+			Expect(m2).To(Equal(m1))
+		})
+
+		It("rejects bad lengths", func() {
+			var m StrategyMap
+			Expect(m.UnmarshalBinary(make([]byte, 33))).NotTo(Succeed())
+		})
+
+		It("rejects unknown strategies", func() {
+			var m StrategyMap
+			buf := make([]byte, maxDigits)
+			buf[3] = 42
+			Expect(m.UnmarshalBinary(buf)).NotTo(Succeed())
+			Expect(m).To(Equal(StrategyMap{}))
+		})
+	})
+})
+
+var strategies = map[string]func() Strategy{
+	"Logoot":        func() Strategy { return Logoot{} },
+	"BoundaryPlus":  func() Strategy { return BoundaryPlus{} },
+	"BoundaryMinus": func() Strategy { return BoundaryMinus{} },
+	"LSEQ":          func() Strategy { return new(LSEQ) },
+	"HashLSEQ":      func() Strategy { return HashLSEQ{Seed: 42} },
+	"Sequential":    func() Strategy { return Sequential{} },
+}
+
+var _ = Describe("Strategy", func() {
+	rnd := rand.New(rand.NewSource(1))
+
+	for name, build := range strategies {
+		name, build := name, build
+		Describe(name, func() {
+			It("picks offsets within the interval", func() {
+				s := build()
+				for k := 0; k < 1000; k++ {
+					interval := 1 + rnd.Intn(100)
+					offset := s.Offset(uint8(k%maxDigits), interval, rnd)
+					Expect(offset).To(BeNumerically(">=", 1))
+					Expect(offset).To(BeNumerically("<=", interval))
+				}
+			})
+
+			It("allocates ordered positions", func() {
+				a := NewAllocator(WithStrategy(build()))
+				Expect(a.Strategy()).NotTo(BeNil())
+				left, right := SentinelHead, SentinelTail
+				for k := 0; k < 50; k++ {
+					q := new(Position)
+					Expect(a.Call(q, left, right, 0xF00F00F0)).To(Succeed())
+					Expect(left.IsBefore(q)).To(BeTrue())
+					Expect(q.IsBefore(right)).To(BeTrue())
+					// alternately narrow from either side
+					if k%2 == 0 {
+						left = q
+					} else {
+						right = q
+					}
+				}
+			})
+		})
+	}
+
+	Describe("BoundaryPlus", func() {
+		It("stays within the boundary of the left bound", func() {
+			for k := 0; k < 1000; k++ {
+				Expect(BoundaryPlus{Boundary: 3}.Offset(0, 100, rnd)).To(BeNumerically("<=", 3))
+			}
+		})
+	})
+
+	Describe("BoundaryMinus", func() {
+		It("stays within the boundary of the right bound", func() {
+			for k := 0; k < 1000; k++ {
+				Expect(BoundaryMinus{Boundary: 3}.Offset(0, 100, rnd)).To(BeNumerically(">", 97))
+			}
+		})
+	})
+
+	Describe("HashLSEQ", func() {
+		It("agrees across replicas sharing a seed", func() {
+			s1, s2 := HashLSEQ{Seed: 42}, HashLSEQ{Seed: 42}
+			for d := uint8(0); d < maxDigits; d++ {
+				Expect(s1.Offset(d, 1000, rnd) <= 10).To(Equal(s2.Offset(d, 1000, rnd) <= 10))
+			}
+		})
+	})
+
+	Describe("Sequential", func() {
+		It("allocates right after the left bound", func() {
+			Expect(Sequential{}.Offset(3, 100, rnd)).To(Equal(1))
+		})
+	})
+})
+
+const maxDigits = 26
+
+// Measure identifier growth (mean digits per position) of each strategy, when
+// typing forwards, typing backwards, and editing at random; and the share of
+// insertions which failed as identifiers hit their maximum length.
+func BenchmarkStrategyGrowth(b *testing.B) {
+	patterns := map[string]func(rnd *rand.Rand, n int) int{
+		"append":  func(_ *rand.Rand, n int) int { return n },
+		"prepend": func(_ *rand.Rand, n int) int { return 0 },
+		"random":  func(rnd *rand.Rand, n int) int { return rnd.Intn(n + 1) },
+	}
+	for pattern, next := range patterns {
+		for name, build := range strategies {
+			b.Run(fmt.Sprintf("pattern=%s/strategy=%s", pattern, name), func(b *testing.B) {
+				rnd := rand.New(rand.NewSource(1))
+				a := NewAllocator(WithStrategy(build()))
+				l := []*Position{SentinelHead, SentinelTail}
+				digits, exhausted := 0, 0
+				for k := 0; k < b.N; k++ {
+					idx := next(rnd, len(l)-2) + 1
+					q := new(Position)
+					if err := a.Call(q, l[idx-1], l[idx], 0xF00F00F0); err != nil {
+						exhausted++
+						continue
+					}
+					l = append(l[:idx], append([]*Position{q}, l[idx:]...)...)
+					digits += q.Length()
+				}
+				b.ReportMetric(float64(digits)/float64(len(l)-2), "digits/pos")
+				b.ReportMetric(float64(exhausted)/float64(b.N), "exhausted/op")
+			})
+		}
+	}
+}
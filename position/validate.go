@@ -0,0 +1,39 @@
+package position
+
+import "errors"
+
+// ErrSentinel is returned by `Validate` for positions equal to a sentinel.
+var ErrSentinel = errors.New("position: position is a sentinel")
+
+// ErrOutOfRange is returned by `Validate` for positions not between the
+// sentinels.
+var ErrOutOfRange = errors.New("position: position is not between the sentinels")
+
+// Validate -
+// Return an error unless `pos` is well-formed, and can be inserted in a
+// document; eg. when received from a peer. Returns:
+//
+//   - a `LengthError` if it has more digits than its shape allows,
+//   - a `*DigitError` if a digit does not fit the base at its depth,
+//   - `ErrSentinel` if it equals the head or tail sentinel of its shape,
+//   - `ErrOutOfRange` if it is not between them.
+func (pos *Position) Validate() error {
+	shape := pos.layout()
+	if len(pos.ids) > int(shape.MaxDigits) {
+		return LengthError(len(pos.ids))
+	}
+	for d, id := range pos.ids {
+		if uint(id.digit) > shape.maxDigitAt(uint8(d)) {
+			return &DigitError{Depth: uint8(d), Digit: uint64(id.digit)}
+		}
+	}
+
+	head, tail := shape.Head(), shape.Tail()
+	switch {
+	case pos.Compare(head) == 0, pos.Compare(tail) == 0:
+		return ErrSentinel
+	case pos.IsBefore(head), tail.IsBefore(pos):
+		return ErrOutOfRange
+	}
+	return nil
+}
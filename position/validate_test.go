@@ -0,0 +1,43 @@
+package position_test
+
+import (
+	. "github.com/mezis/lseq/position"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	It("accepts positions between the sentinels", func() {
+		for _, s := range []string{"<1>", "<0 @DEADBEEF>", "<0, 1>", "<30, 63 @DEADBEEF>", "<12/0/8: 4094, 4095>"} {
+			p, err := Parse(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Validate()).To(Succeed(), s)
+		}
+	})
+
+	It("accepts allocated positions", func() {
+		a := NewAllocator()
+		for k := 0; k < 100; k++ {
+			p := new(Position)
+			Expect(a.Call(p, SentinelHead, SentinelTail, 0xF00F00F0)).To(Succeed())
+			Expect(p.Validate()).To(Succeed())
+		}
+	})
+
+	It("rejects the sentinels", func() {
+		for _, s := range []string{"<>", "<0>", "<0, 0>", "<31>", "<31, 0, 0>", "<3/2/12: 7>"} {
+			p, err := Parse(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Validate()).To(MatchError(ErrSentinel), s)
+		}
+	})
+
+	It("rejects positions past the tail sentinel", func() {
+		for _, s := range []string{"<31, 1>", "<31 @DEADBEEF>", "<3/2/12: 7, 1>"} {
+			p, err := Parse(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Validate()).To(MatchError(ErrOutOfRange), s)
+		}
+	})
+})